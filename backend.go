@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bench-multiget/pb"
+)
+
+// BatchStats is the stats of a single multi get call
+type BatchStats struct {
+	// L1HitCount is the number of keys got from an in-process cache, HitCount and MissCount only count the other keys
+	L1HitCount uint64
+
+	HitCount   uint64
+	MissCount  uint64
+	TotalBytes uint64
+
+	// NotFoundCount is the number of skus not existing in the backend,
+	// NegativeHitCount is the number of those served from cached tombstones
+	NotFoundCount    uint64
+	NegativeHitCount uint64
+
+	// StaleServeCount is the number of values served after their soft expiry,
+	// RefreshCount is the number of those refreshed in the background by this call
+	StaleServeCount uint64
+	RefreshCount    uint64
+
+	// EntityGetCount and EntityMissCount are the brands and attributes got from the cache by the normalized model,
+	// HitCount and MissCount only count the products
+	EntityGetCount  uint64
+	EntityMissCount uint64
+
+	// DecodeCount, DecodeBytes and DecodeTime are the number, the encoded size
+	// and the time spent decoding the values got from the cache.
+	// DecodeRawBytes and DecompressTime are the size after decompression and the part of DecodeTime decompressing
+	DecodeCount    uint64
+	DecodeBytes    uint64
+	DecodeRawBytes uint64
+	DecodeTime     time.Duration
+	DecompressTime time.Duration
+}
+
+func (s *BatchStats) addDecodeStats(d DecodeStats) {
+	s.DecodeCount += d.Count
+	s.DecodeBytes += d.Bytes
+	s.DecodeRawBytes += d.RawBytes
+	s.DecodeTime += d.Duration
+	s.DecompressTime += d.DecompressDuration
+}
+
+// MultiGetBackend is implemented by every store the benchmark driver can run against
+type MultiGetBackend interface {
+	GetProducts(ctx context.Context, skus []string) ([]*pb.Product, BatchStats, error)
+}
+
+type Stats struct {
+	KeyCount   atomic.Uint64
+	L1HitCount atomic.Uint64
+	HitCount   atomic.Uint64
+	MissCount  atomic.Uint64
+	TotalBytes atomic.Uint64
+
+	NotFoundCount    atomic.Uint64
+	NegativeHitCount atomic.Uint64
+
+	StaleServeCount atomic.Uint64
+	RefreshCount    atomic.Uint64
+
+	EntityGetCount  atomic.Uint64
+	EntityMissCount atomic.Uint64
+
+	DecodeCount     atomic.Uint64
+	DecodeBytes     atomic.Uint64
+	DecodeRawBytes  atomic.Uint64
+	DecodeNanos     atomic.Uint64
+	DecompressNanos atomic.Uint64
+
+	WriteCount     atomic.Uint64
+	StaleReadCount atomic.Uint64
+}
+
+func (s *Stats) add(numKeys int, batch BatchStats) {
+	s.KeyCount.Add(uint64(numKeys))
+	s.L1HitCount.Add(batch.L1HitCount)
+	s.HitCount.Add(batch.HitCount)
+	s.MissCount.Add(batch.MissCount)
+	s.TotalBytes.Add(batch.TotalBytes)
+	s.NotFoundCount.Add(batch.NotFoundCount)
+	s.NegativeHitCount.Add(batch.NegativeHitCount)
+	s.StaleServeCount.Add(batch.StaleServeCount)
+	s.RefreshCount.Add(batch.RefreshCount)
+	s.EntityGetCount.Add(batch.EntityGetCount)
+	s.EntityMissCount.Add(batch.EntityMissCount)
+	s.DecodeCount.Add(batch.DecodeCount)
+	s.DecodeBytes.Add(batch.DecodeBytes)
+	s.DecodeRawBytes.Add(batch.DecodeRawBytes)
+	s.DecodeNanos.Add(uint64(batch.DecodeTime))
+	s.DecompressNanos.Add(uint64(batch.DecompressTime))
+}
+
+func newAllSkus(numProducts int) []string {
+	return withIndex(numProducts, func(i int) string {
+		return fmt.Sprintf("SKU%07d", i+1)
+	})
+}
+
+// runPhases splits a run into warmup, measured and cooldown phases.
+// Only batches started inside the measured phase are recorded.
+type runPhases struct {
+	start        time.Time
+	measureStart time.Time
+
+	// measureEnd and end are zero when the measured phase is bounded by number of loops instead of time
+	measureEnd time.Time
+	end        time.Time
+}
+
+func newRunPhases(conf benchConfig, start time.Time) runPhases {
+	p := runPhases{
+		start:        start,
+		measureStart: start.Add(conf.Warmup),
+	}
+	if conf.Duration > 0 {
+		p.measureEnd = p.measureStart.Add(conf.Duration)
+		p.end = p.measureEnd.Add(conf.Cooldown)
+	}
+	return p
+}
+
+func (p runPhases) timeBounded() bool {
+	return !p.end.IsZero()
+}
+
+func (p runPhases) isMeasured(t time.Time) bool {
+	if t.Before(p.measureStart) {
+		return false
+	}
+	return !p.timeBounded() || t.Before(p.measureEnd)
+}
+
+type multiGetDriver struct {
+	backend MultiGetBackend
+	conf    benchConfig
+	phases  runPhases
+
+	// writer and revisions are only set for the mixed read / write workload
+	writer    ProductWriter
+	revisions *revisionTracker
+
+	stats Stats
+}
+
+// driverWorker is the state owned by a single worker goroutine
+type driverWorker struct {
+	rand      *rand.Rand
+	hist      *Histogram
+	writeHist *Histogram
+	keys      KeySelector
+	errors    *errorCounter
+
+	skus     []string
+	expected []uint64
+}
+
+// doOperation does a product write with probability of the write ratio, otherwise a multi get
+func (d *multiGetDriver) doOperation(w *driverWorker, intendedStart time.Time) {
+	if d.writer != nil && w.rand.Float64() < d.conf.WriteRatio {
+		d.doWrite(w, intendedStart)
+		return
+	}
+	d.doBatch(w, intendedStart)
+}
+
+// errNotFoundProduct is returned for a batch containing an empty product,
+// not existing skus are returned as nil products instead
+var errNotFoundProduct = withErrorKind(errKindNotFound, errors.New("not found product"))
+
+// doBatch does a single multi get and records its latency, measured from the intended start time,
+// batches in warmup and cooldown phases are not recorded.
+// Failed batches are counted per error kind and are not added to the latency histogram
+func (d *multiGetDriver) doBatch(w *driverWorker, intendedStart time.Time) {
+	w.skus = w.keys.NextBatch(w.skus)
+	skus := w.skus
+
+	if d.revisions != nil {
+		w.expected = d.revisions.snapshot(w.expected, skus)
+	}
+
+	products, batchStats, err := d.backend.GetProducts(context.Background(), skus)
+	if err == nil && len(products) > 0 && products[0] != nil && products[0].Sku == "" {
+		err = errNotFoundProduct
+	}
+	if !d.phases.isMeasured(intendedStart) {
+		return
+	}
+	if err != nil {
+		w.errors.add("", err)
+		return
+	}
+
+	w.hist.Record(time.Since(intendedStart))
+	d.stats.add(len(skus), batchStats)
+
+	if d.revisions != nil {
+		d.stats.StaleReadCount.Add(countStale(skus, w.expected, products))
+	}
+}
+
+// doWrite updates a single product chosen by the key distribution
+func (d *multiGetDriver) doWrite(w *driverWorker, intendedStart time.Time) {
+	w.skus = w.keys.NextBatch(w.skus)
+	index := skuIndex(w.skus[0])
+
+	err := d.revisions.write(index, func(revision uint64) error {
+		return d.writer.UpdateProducts(context.Background(), []*pb.Product{
+			newProductRevision(index, revision),
+		})
+	})
+	if !d.phases.isMeasured(intendedStart) {
+		return
+	}
+	if err != nil {
+		w.errors.add("write/", err)
+		return
+	}
+
+	w.writeHist.Record(time.Since(intendedStart))
+	d.stats.WriteCount.Add(1)
+}
+
+// runClosedLoop each thread does multi gets as fast as possible,
+// until the end of the run or until numLoops measured multi gets are done
+func (d *multiGetDriver) runClosedLoop(workers []*driverWorker) {
+	var wg sync.WaitGroup
+	wg.Add(len(workers))
+
+	for _, w := range workers {
+		w := w
+
+		go func() {
+			defer wg.Done()
+
+			if d.phases.timeBounded() {
+				for now := time.Now(); now.Before(d.phases.end); now = time.Now() {
+					d.doOperation(w, now)
+				}
+				return
+			}
+
+			for now := time.Now(); now.Before(d.phases.measureStart); now = time.Now() {
+				d.doOperation(w, now)
+			}
+			for i := 0; i < d.conf.NumLoops; i++ {
+				d.doOperation(w, time.Now())
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// runOpenLoop issues multi gets at the fixed target rate, until the end of the run
+// or until numThreads * numLoops measured multi gets are issued.
+// The latency of each batch is measured from its scheduled send time instead of the actual send time,
+// so the time a batch waits for a free worker is included (coordinated omission correction).
+func (d *multiGetDriver) runOpenLoop(workers []*driverWorker) {
+	totalBatches := d.conf.NumThreads * d.conf.NumLoops
+	interval := float64(time.Second) * float64(d.conf.NumSkusPerBatch) / d.conf.Rate
+
+	const maxPending = 1 << 16
+	schedule := make(chan time.Time, maxPending)
+
+	go func() {
+		defer close(schedule)
+
+		measured := 0
+		for i := 0; ; i++ {
+			intended := d.phases.start.Add(time.Duration(float64(i) * interval))
+			if d.phases.timeBounded() {
+				if !intended.Before(d.phases.end) {
+					return
+				}
+			} else if d.phases.isMeasured(intended) {
+				if measured >= totalBatches {
+					return
+				}
+				measured++
+			}
+
+			if wait := time.Until(intended); wait > 0 {
+				time.Sleep(wait)
+			}
+			schedule <- intended
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(len(workers))
+
+	for _, w := range workers {
+		w := w
+
+		go func() {
+			defer wg.Done()
+
+			for intended := range schedule {
+				d.doOperation(w, intended)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// runMultiGet runs the benchmark in closed loop mode, or in open loop mode when a target rate is configured
+func runMultiGet(backend MultiGetBackend, name string, conf benchConfig) (benchResult, error) {
+	start := time.Now()
+
+	d := &multiGetDriver{
+		backend: backend,
+		conf:    conf,
+		phases:  newRunPhases(conf, start),
+	}
+
+	if conf.WriteRatio > 0 {
+		writer, ok := backend.(ProductWriter)
+		if !ok {
+			return benchResult{}, fmt.Errorf("backend '%s' does not support writes", name)
+		}
+		d.writer = writer
+		d.revisions = newRevisionTracker(conf.NumProducts, uint64(start.UnixNano()))
+	}
+
+	allSkus := newAllSkus(conf.NumProducts)
+	seed := time.Now().UnixNano()
+
+	workers := withIndex(conf.NumThreads, func(i int) *driverWorker {
+		return &driverWorker{
+			rand:      rand.New(rand.NewSource(-seed - int64(i))),
+			hist:      NewHistogram(),
+			writeHist: NewHistogram(),
+			keys:      newKeySelector(conf.Keys, allSkus, conf.NumSkusPerBatch, seed+int64(i)),
+			errors:    newErrorCounter(),
+		}
+	})
+
+	if conf.Rate > 0 {
+		d.runOpenLoop(workers)
+	} else {
+		d.runClosedLoop(workers)
+	}
+
+	duration := conf.Duration
+	if !d.phases.timeBounded() {
+		duration = time.Since(d.phases.measureStart)
+	}
+
+	latency := NewHistogram()
+	writeLatency := NewHistogram()
+	errorCounts := newErrorCounter()
+	for _, w := range workers {
+		latency.Merge(w.hist)
+		writeLatency.Merge(w.writeHist)
+		errorCounts.merge(w.errors)
+	}
+
+	return benchResult{
+		Backend: name,
+		Config:  conf,
+
+		Timestamp: start,
+		Env:       currentRunEnv(),
+
+		Duration:   duration,
+		TotalKeys:  d.stats.KeyCount.Load(),
+		L1HitCount: d.stats.L1HitCount.Load(),
+		HitCount:   d.stats.HitCount.Load(),
+		MissCount:  d.stats.MissCount.Load(),
+		TotalBytes: d.stats.TotalBytes.Load(),
+
+		NotFoundCount:    d.stats.NotFoundCount.Load(),
+		NegativeHitCount: d.stats.NegativeHitCount.Load(),
+
+		StaleServeCount: d.stats.StaleServeCount.Load(),
+		RefreshCount:    d.stats.RefreshCount.Load(),
+
+		EntityGetCount:  d.stats.EntityGetCount.Load(),
+		EntityMissCount: d.stats.EntityMissCount.Load(),
+
+		DecodeCount:    d.stats.DecodeCount.Load(),
+		DecodeBytes:    d.stats.DecodeBytes.Load(),
+		DecodeRawBytes: d.stats.DecodeRawBytes.Load(),
+		DecodeTime:     time.Duration(d.stats.DecodeNanos.Load()),
+		DecompressTime: time.Duration(d.stats.DecompressNanos.Load()),
+
+		Latency: latency,
+
+		WriteCount:     d.stats.WriteCount.Load(),
+		StaleReadCount: d.stats.StaleReadCount.Load(),
+		WriteLatency:   writeLatency,
+
+		Errors: errorCounts,
+	}, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bench-multiget/pb"
+)
+
+type fakeBackend struct {
+	calls atomic.Uint64
+}
+
+func (b *fakeBackend) GetProducts(_ context.Context, skus []string) ([]*pb.Product, BatchStats, error) {
+	b.calls.Add(1)
+	products := mapSlice(skus, func(sku string) *pb.Product {
+		return &pb.Product{Sku: sku}
+	})
+	return products, BatchStats{
+		HitCount:   uint64(len(skus)),
+		TotalBytes: 100,
+	}, nil
+}
+
+func mustRunMultiGet(t *testing.T, backend MultiGetBackend, name string, conf benchConfig) benchResult {
+	t.Helper()
+
+	r, err := runMultiGet(backend, name, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRunMultiGet(t *testing.T) {
+	conf := defaultBenchConfig()
+	conf.NumProducts = 100
+	conf.NumThreads = 4
+	conf.NumSkusPerBatch = 10
+	conf.NumLoops = 50
+
+	backend := &fakeBackend{}
+	r := mustRunMultiGet(t, backend, "fake", conf)
+
+	if backend.calls.Load() != 4*50 {
+		t.Errorf("unexpected number of calls: %d", backend.calls.Load())
+	}
+	if r.Backend != "fake" {
+		t.Errorf("unexpected backend: %s", r.Backend)
+	}
+	if r.TotalKeys != 4*50*10 || r.HitCount != 4*50*10 || r.MissCount != 0 {
+		t.Errorf("unexpected result: %+v", r)
+	}
+	if r.TotalBytes != 4*50*100 {
+		t.Errorf("unexpected total bytes: %d", r.TotalBytes)
+	}
+	if r.Latency.Count() != 4*50 {
+		t.Errorf("unexpected number of latency records: %d", r.Latency.Count())
+	}
+}
+
+func TestRunMultiGet_OpenLoop(t *testing.T) {
+	conf := defaultBenchConfig()
+	conf.NumProducts = 100
+	conf.NumThreads = 4
+	conf.NumSkusPerBatch = 10
+	conf.NumLoops = 25
+	conf.Rate = 10_000
+
+	backend := &fakeBackend{}
+	r := mustRunMultiGet(t, backend, "fake", conf)
+
+	if backend.calls.Load() != 4*25 {
+		t.Errorf("unexpected number of calls: %d", backend.calls.Load())
+	}
+	if r.Latency.Count() != 4*25 {
+		t.Errorf("unexpected number of latency records: %d", r.Latency.Count())
+	}
+
+	// 1000 keys at 10000 keys per second, the last batch is scheduled at 99ms
+	if r.Duration < 99*time.Millisecond {
+		t.Errorf("open loop finished too early: %v", r.Duration)
+	}
+	if r.getsPerSecond() > conf.Rate*1.05 {
+		t.Errorf("rate exceeded target: %v", r.getsPerSecond())
+	}
+}
+
+func TestRunMultiGet_WithDurationAndWarmup(t *testing.T) {
+	conf := defaultBenchConfig()
+	conf.NumProducts = 100
+	conf.NumThreads = 2
+	conf.NumSkusPerBatch = 10
+	conf.Rate = 10_000
+	conf.Warmup = 50 * time.Millisecond
+	conf.Duration = 100 * time.Millisecond
+	conf.Cooldown = 20 * time.Millisecond
+
+	backend := &fakeBackend{}
+	r := mustRunMultiGet(t, backend, "fake", conf)
+
+	if r.Duration != conf.Duration {
+		t.Errorf("unexpected duration: %v", r.Duration)
+	}
+
+	// the batches of the warmup and cooldown phases are done but not measured
+	measured := r.Latency.Count()
+	if measured == 0 {
+		t.Fatal("expected measured batches")
+	}
+	if calls := backend.calls.Load(); calls <= measured {
+		t.Errorf("expected unmeasured warmup batches, got %d calls for %d measured batches", calls, measured)
+	}
+	if r.TotalKeys != measured*10 {
+		t.Errorf("unexpected total keys: %d", r.TotalKeys)
+	}
+}
+
+func TestRunPhases_IsMeasured(t *testing.T) {
+	conf := defaultBenchConfig()
+	conf.Warmup = 50 * time.Millisecond
+	conf.Duration = 100 * time.Millisecond
+	conf.Cooldown = 20 * time.Millisecond
+
+	start := time.Now()
+	p := newRunPhases(conf, start)
+	if !p.timeBounded() || !p.end.Equal(start.Add(170*time.Millisecond)) {
+		t.Errorf("unexpected end: %v", p.end.Sub(start))
+	}
+
+	for _, c := range []struct {
+		offset   time.Duration
+		measured bool
+	}{
+		{0, false},
+		{49 * time.Millisecond, false},
+		{50 * time.Millisecond, true},
+		{149 * time.Millisecond, true},
+		{150 * time.Millisecond, false},
+		{169 * time.Millisecond, false},
+	} {
+		if p.isMeasured(start.Add(c.offset)) != c.measured {
+			t.Errorf("unexpected measured phase at %v", c.offset)
+		}
+	}
+
+	// without duration, the measured phase has no end
+	conf.Duration = 0
+	p = newRunPhases(conf, start)
+	if p.timeBounded() || !p.isMeasured(start.Add(time.Hour)) {
+		t.Error("expected an unbounded measured phase")
+	}
+}
+
+// failingBackend fails every n-th call with a memcached error and returns an empty product every m-th call
+type failingBackend struct {
+	fakeBackend
+	failEvery     uint64
+	notFoundEvery uint64
+}
+
+func (b *failingBackend) GetProducts(ctx context.Context, skus []string) ([]*pb.Product, BatchStats, error) {
+	products, stats, _ := b.fakeBackend.GetProducts(ctx, skus)
+	n := b.calls.Load()
+	if n%b.failEvery == 0 {
+		return nil, BatchStats{}, withErrorKind(errKindMemcached, errors.New("connection reset"))
+	}
+	if n%b.notFoundEvery == 0 {
+		products[0] = &pb.Product{}
+	}
+	return products, stats, nil
+}
+
+func TestRunMultiGet_CountErrors(t *testing.T) {
+	conf := defaultBenchConfig()
+	conf.NumProducts = 100
+	conf.NumThreads = 1
+	conf.NumSkusPerBatch = 10
+	conf.NumLoops = 100
+
+	backend := &failingBackend{failEvery: 10, notFoundEvery: 25}
+	r := mustRunMultiGet(t, backend, "fake", conf)
+
+	if backend.calls.Load() != 100 {
+		t.Errorf("expected the run to continue after errors, calls: %d", backend.calls.Load())
+	}
+	if r.Errors.counts[errKindMemcached] != 10 {
+		t.Errorf("unexpected memcached errors: %v", r.Errors.counts)
+	}
+	// call 50 and 100 fail with memcached errors first
+	if r.Errors.counts[errKindNotFound] != 2 {
+		t.Errorf("unexpected not found errors: %v", r.Errors.counts)
+	}
+	if r.Latency.Count() != 88 {
+		t.Errorf("failed batches must not be recorded: %d", r.Latency.Count())
+	}
+	if rate := r.errorRate(); rate != 0.12 {
+		t.Errorf("unexpected error rate: %v", rate)
+	}
+	if r.Errors.samples[errKindMemcached] != "memcached: connection reset" {
+		t.Errorf("unexpected error sample: %v", r.Errors.samples)
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	ctxErr := fmt.Errorf("get products: %w", context.DeadlineExceeded)
+	if kind := errorKind(withErrorKind(errKindMemcached, ctxErr)); kind != errKindTimeout {
+		t.Errorf("unexpected kind: %s", kind)
+	}
+
+	mysqlErr := withErrorKind(errKindMySQL, errors.New("bad connection"))
+	if kind := errorKind(withErrorKind(errKindMemcached, mysqlErr)); kind != errKindMySQL {
+		t.Errorf("the first kind must be kept: %s", kind)
+	}
+	if kind := errorKind(errors.New("some error")); kind != errKindOther {
+		t.Errorf("unexpected kind: %s", kind)
+	}
+}
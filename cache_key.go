@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"bench-multiget/pb"
+)
+
+// keyVersionAuto derives the schema version of the cache keys from the proto descriptor
+const keyVersionAuto = "auto"
+
+// descriptorMessage is implemented by the generated messages
+type descriptorMessage interface {
+	Descriptor() ([]byte, []int)
+}
+
+// schemaVersion is a hash of the file descriptor the message is defined in and of the value layout version,
+// so any change of the .proto file or of the value layout moves the cached values to new keys
+func schemaVersion(m descriptorMessage, layoutVersion byte) string {
+	fd, _ := m.Descriptor()
+	h := fnv.New32a()
+	_, _ = h.Write(fd)
+	_, _ = h.Write([]byte{layoutVersion})
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// productSchemaVersion resolves the configured version of the product keys
+func productSchemaVersion(version string) string {
+	if version == keyVersionAuto {
+		return schemaVersion(&pb.Product{}, valueLayoutVersion)
+	}
+	return version
+}
+
+func validateKeyPart(name string, value string) error {
+	if strings.ContainsAny(value, "/ \t\r\n") {
+		return fmt.Errorf("%s '%s' must not contain '/' or whitespaces", name, value)
+	}
+	return nil
+}
+
+func validateKeyPrefix(namespace string, version string) error {
+	if err := validateKeyPart("key namespace", namespace); err != nil {
+		return err
+	}
+	if err := validateKeyPart("key version", version); err != nil {
+		return err
+	}
+	if len(namespace)+len(version) > 100 {
+		return errors.New("key namespace and key version are too long")
+	}
+	return nil
+}
+
+// cacheKeyPrefix returns "<namespace>/v<version>/", each part is omitted when empty.
+// The prefix is empty for the unversioned keys
+func cacheKeyPrefix(namespace string, version string) string {
+	var b strings.Builder
+	if namespace != "" {
+		b.WriteString(namespace)
+		b.WriteString("/")
+	}
+	if version != "" {
+		b.WriteString("v")
+		b.WriteString(version)
+		b.WriteString("/")
+	}
+	return b.String()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"bench-multiget/pb"
+)
+
+func TestProductCacheKey_String(t *testing.T) {
+	cases := []struct {
+		key      ProductCacheKey
+		expected string
+	}{
+		{ProductCacheKey{Sku: "SKU01"}, "p/SKU01"},
+		{ProductCacheKey{Format: "json+zstd", Sku: "SKU01"}, "p:json+zstd/SKU01"},
+		{ProductCacheKey{Prefix: cacheKeyPrefix("bench", ""), Sku: "SKU01"}, "bench/p/SKU01"},
+		{ProductCacheKey{Prefix: cacheKeyPrefix("", "3"), Sku: "SKU01"}, "v3/p/SKU01"},
+		{
+			ProductCacheKey{Prefix: cacheKeyPrefix("bench", "3"), Format: "json+zstd", Sku: "SKU01"},
+			"bench/v3/p:json+zstd/SKU01",
+		},
+	}
+	for _, c := range cases {
+		if s := c.key.String(); s != c.expected {
+			t.Errorf("expected '%s', got '%s'", c.expected, s)
+		}
+	}
+}
+
+func TestProductSchemaVersion(t *testing.T) {
+	version := productSchemaVersion(keyVersionAuto)
+	if len(version) != 8 || version != productSchemaVersion(keyVersionAuto) {
+		t.Errorf("unexpected schema version: '%s'", version)
+	}
+	if v := schemaVersion(&pb.Product{}, valueLayoutVersion+1); v == version {
+		t.Errorf("a new value layout must change the schema version: '%s'", v)
+	}
+	if v := productSchemaVersion("2024-01"); v != "2024-01" {
+		t.Errorf("configured version must be used as is: '%s'", v)
+	}
+
+	if err := validateKeyPrefix("bench", version); err != nil {
+		t.Error(err)
+	}
+	if err := validateKeyPrefix("bench/a", version); err == nil {
+		t.Error("expected error for namespace containing '/'")
+	}
+	if err := validateKeyPrefix("bench", "v 1"); err == nil {
+		t.Error("expected error for version containing a space")
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"sync/atomic"
+	"log"
+	"sync"
+	"time"
 
 	"github.com/QuangTung97/memproxy"
 	"github.com/QuangTung97/memproxy/item"
@@ -14,23 +16,145 @@ import (
 )
 
 type CacheRepo struct {
-	db     *sqlx.DB
-	client memproxy.Memcache
+	store   productStore
+	client  memproxy.Memcache
+	options cacheRepoOptions
+
+	brands     *entityCache[*pb.Brand]
+	attributes *entityCache[*pb.Attribute]
+
+	// refreshing contains the skus being refreshed in the background, at most one refresh per sku
+	refreshing sync.Map
+	// refreshWg tracks the refresh goroutines, see Close
+	refreshWg sync.WaitGroup
+}
+
+type cacheRepoOptions struct {
+	ttl         time.Duration
+	softTTL     time.Duration
+	negativeTTL time.Duration
+	format      ValueFormat[*pb.Product]
+
+	// normalized caches slim products, the brands and the attributes are cached separately
+	normalized bool
+
+	// keyPrefix is the namespace and the schema version of the keys, empty for the unversioned keys
+	keyPrefix string
+
+	// l1 is nil when the in-process cache is disabled
+	l1 *l1Cache
+}
+
+// CacheRepoOption configures the cache repo created by NewCacheRepo
+type CacheRepoOption func(opts *cacheRepoOptions)
+
+// WithTTL sets the memcached TTL of the cached products, zero means no expiry
+func WithTTL(ttl time.Duration) CacheRepoOption {
+	return func(opts *cacheRepoOptions) {
+		opts.ttl = ttl
+	}
+}
+
+// WithSoftTTL enables stale-while-revalidate: products older than the soft TTL are still served,
+// and are refreshed from the database in the background. Zero means never stale
+func WithSoftTTL(ttl time.Duration) CacheRepoOption {
+	return func(opts *cacheRepoOptions) {
+		opts.softTTL = ttl
+	}
+}
+
+// WithNegativeTTL sets the TTL of the tombstones cached for not found skus, zero means no expiry
+func WithNegativeTTL(ttl time.Duration) CacheRepoOption {
+	return func(opts *cacheRepoOptions) {
+		opts.negativeTTL = ttl
+	}
+}
+
+// WithCodec sets the codec of the cached products, default is gogo
+func WithCodec(codec Codec[*pb.Product]) CacheRepoOption {
+	return func(opts *cacheRepoOptions) {
+		opts.format.Codec = codec
+	}
+}
+
+// WithCompression sets the compression of the cached products, default is none
+func WithCompression(c Compressor) CacheRepoOption {
+	return func(opts *cacheRepoOptions) {
+		opts.format.Compression = c
+	}
 }
 
-func NewCacheRepo(db *sqlx.DB, client memproxy.Memcache) *CacheRepo {
-	return &CacheRepo{
-		db:     db,
+// WithKeyPrefix sets the namespace and the schema version of the cache keys,
+// values written with another schema version are never read
+func WithKeyPrefix(namespace string, version string) CacheRepoOption {
+	return func(opts *cacheRepoOptions) {
+		opts.keyPrefix = cacheKeyPrefix(namespace, version)
+	}
+}
+
+// WithNormalizedModel caches the products without their brand and attributes,
+// which are cached once per id and assembled into the products on read
+func WithNormalizedModel() CacheRepoOption {
+	return func(opts *cacheRepoOptions) {
+		opts.normalized = true
+	}
+}
+
+// WithL1Cache enables the in-process cache consulted before memcached
+func WithL1Cache(c *l1Cache) CacheRepoOption {
+	return func(opts *cacheRepoOptions) {
+		opts.l1 = c
+	}
+}
+
+func NewCacheRepo(db *sqlx.DB, client memproxy.Memcache, options ...CacheRepoOption) *CacheRepo {
+	return newCacheRepo(&mysqlStore{db: db}, client, options...)
+}
+
+func newCacheRepo(store productStore, client memproxy.Memcache, options ...CacheRepoOption) *CacheRepo {
+	r := &CacheRepo{
+		store:  store,
 		client: client,
+		options: cacheRepoOptions{
+			format: defaultValueFormat[*pb.Product](),
+		},
+	}
+	for _, opt := range options {
+		opt(&r.options)
 	}
+
+	r.brands = newEntityCache(r, entityKindBrand, "brands", func() *pb.Brand {
+		return &pb.Brand{}
+	})
+	r.attributes = newEntityCache(r, entityKindAttribute, "attributes", func() *pb.Attribute {
+		return &pb.Attribute{}
+	})
+	return r
 }
 
 type ProductCacheKey struct {
+	// Prefix is the namespace and the schema version, see cacheKeyPrefix
+	Prefix string
+
+	// Format is empty for the default value format, values of other formats are stored under different keys.
+	// The writes invalidate the keys of every format and model, see productKeyVariants
+	Format string
+
+	// Slim is set for the products of the normalized model
+	Slim bool
+
 	Sku string
 }
 
 func (k ProductCacheKey) String() string {
-	return fmt.Sprintf("p/%s", k.Sku)
+	kind := "p"
+	if k.Slim {
+		kind = "ps"
+	}
+	if k.Format == "" {
+		return fmt.Sprintf("%s%s/%s", k.Prefix, kind, k.Sku)
+	}
+	return fmt.Sprintf("%s%s:%s/%s", k.Prefix, kind, k.Format, k.Sku)
 }
 
 func getProductKey(p *pb.Product) ProductCacheKey {
@@ -47,49 +171,269 @@ func mapSlice[A, B any](input []A, fn func(e A) B) []B {
 	return result
 }
 
-type GetProductFunc = func() (CacheValue[*pb.Product], error)
+type ProductCacheValue = CacheValue[*pb.Product]
 
-type Stats struct {
-	HitCount   atomic.Uint64
-	MissCount  atomic.Uint64
-	TotalBytes atomic.Uint64
-}
+type GetProductFunc = func() (ProductCacheValue, error)
 
 func newProductProto() *pb.Product {
 	return &pb.Product{}
 }
 
-type GetState = item.GetState[CacheValue[*pb.Product], ProductCacheKey]
+func (r *CacheRepo) productKey(sku string) ProductCacheKey {
+	return ProductCacheKey{
+		Prefix: r.options.keyPrefix,
+		Format: r.options.format.Name(),
+		Slim:   r.options.normalized,
+		Sku:    sku,
+	}
+}
 
-func (r *CacheRepo) GetProducts(ctx context.Context, skus []string, globalStats *Stats) []*pb.Product {
-	pipe := r.client.Pipeline(ctx)
+// productKeyVariants returns the keys of the sku for every format and model
+func (r *CacheRepo) productKeyVariants(sku string) []ProductCacheKey {
+	var keys []ProductCacheKey
+	for _, slim := range []bool{false, true} {
+		for _, format := range valueFormatNames() {
+			keys = append(keys, ProductCacheKey{
+				Prefix: r.options.keyPrefix,
+				Format: format,
+				Slim:   slim,
+				Sku:    sku,
+			})
+		}
+	}
+	return keys
+}
+
+// cachedProduct is the product stored in the cache, slim for the normalized model
+func (r *CacheRepo) cachedProduct(p *pb.Product) *pb.Product {
+	if r.options.normalized {
+		return slimProduct(p)
+	}
+	return p
+}
+
+func (r *CacheRepo) getProductValueKey(v ProductCacheValue) ProductCacheKey {
+	return r.productKey(v.Data.Sku)
+}
+
+type GetState = item.GetState[ProductCacheValue, ProductCacheKey]
+
+// GetProducts returns the products in the same order as skus, with nil for the not found skus
+func (r *CacheRepo) GetProducts(ctx context.Context, skus []string) ([]*pb.Product, BatchStats, error) {
+	l1 := r.options.l1
+	if l1 == nil {
+		return r.getProductsFromMemcache(ctx, skus)
+	}
+
+	now := time.Now()
+	result := make([]*pb.Product, len(skus))
+
+	var l1Hits, notFound uint64
+	var missSkus []string
+	var missIndexes []int
+	var missGenerations []uint64
+
+	for i, sku := range skus {
+		p, ok := l1.get(sku, now)
+		if !ok {
+			missSkus = append(missSkus, sku)
+			missIndexes = append(missIndexes, i)
+			missGenerations = append(missGenerations, l1.generation(sku))
+			continue
+		}
+
+		l1Hits++
+		if p == nil {
+			notFound++
+		}
+		result[i] = p
+	}
+
+	var stats BatchStats
+	if len(missSkus) > 0 {
+		products, memcacheStats, err := r.getProductsFromMemcache(ctx, missSkus)
+		if err != nil {
+			return nil, BatchStats{}, err
+		}
+		for i, p := range products {
+			result[missIndexes[i]] = p
+			l1.fill(missSkus[i], p, now, missGenerations[i])
+		}
+		stats = memcacheStats
+	}
+
+	stats.L1HitCount = l1Hits
+	stats.NotFoundCount += notFound
+	return result, stats, nil
+}
+
+func (r *CacheRepo) getProductsFromMemcache(ctx context.Context, skus []string) ([]*pb.Product, BatchStats, error) {
+	pipe := r.newPipeline(ctx)
 	defer pipe.Finish()
 
-	filler := item.NewMultiGetFiller[*pb.Product, ProductCacheKey](
-		r.getProductsForCache, getProductKey,
+	// skus missing from the database get the zero value, a tombstone
+	filler := item.NewMultiGetFiller[ProductCacheValue, ProductCacheKey](
+		r.getProductValuesForCache, r.getProductValueKey,
+	)
+	productCache := NewCacheItem[*pb.Product, ProductCacheKey](
+		pipe, newProductProto, r.options.format, filler,
+		WithItemSoftTTL(r.options.softTTL),
 	)
-	productCache := NewCacheItem[*pb.Product, ProductCacheKey](pipe, newProductProto, filler)
 
 	fnList := mapSlice(skus, func(sku string) *GetState {
-		return productCache.GetFast(ctx, ProductCacheKey{
-			Sku: sku,
-		})
+		return productCache.GetFast(ctx, r.productKey(sku))
 	})
 
-	defer func() {
-		stats := productCache.GetStats()
-		globalStats.MissCount.Add(stats.FillCount)
-		globalStats.HitCount.Add(stats.HitCount)
-		globalStats.TotalBytes.Add(stats.TotalBytesRecv)
-	}()
+	now := time.Now()
 
-	return mapSlice(fnList, func(fn *GetState) *pb.Product {
+	var notFound uint64
+	var staleSkus []string
+	result := make([]*pb.Product, 0, len(fnList))
+	for i, fn := range fnList {
 		resp, err := fn.Result()
 		if err != nil {
-			panic(err)
+			// errors from the filler are already tagged with their kind
+			return nil, BatchStats{}, withErrorKind(errKindMemcached, err)
+		}
+		if !resp.Found {
+			notFound++
+		}
+		if resp.isStale(now) {
+			staleSkus = append(staleSkus, skus[i])
+		}
+		result = append(result, resp.Data)
+	}
+
+	var stats BatchStats
+	if r.options.normalized {
+		products, entityStats, err := r.getNormalizedProducts(ctx, pipe, result)
+		if err != nil {
+			return nil, BatchStats{}, err
 		}
-		return resp.Data
+		result = products
+		stats = entityStats
+	}
+
+	itemStats := productCache.GetStats()
+	stats.HitCount = itemStats.HitCount
+	stats.MissCount = itemStats.FillCount
+	stats.TotalBytes += itemStats.TotalBytesRecv
+
+	stats.NotFoundCount = notFound
+	stats.NegativeHitCount = productCache.NegativeHitCount()
+
+	stats.StaleServeCount = uint64(len(staleSkus))
+	stats.RefreshCount = r.refreshInBackground(staleSkus)
+
+	stats.addDecodeStats(productCache.GetDecodeStats())
+	return result, stats, nil
+}
+
+func (r *CacheRepo) newPipeline(ctx context.Context) memproxy.Pipeline {
+	return withTTL(r.client.Pipeline(ctx), r.options.ttl, r.options.negativeTTL)
+}
+
+const refreshTimeout = 5 * time.Second
+
+// refreshInBackground starts the refresh of the stale skus that are not already being refreshed
+// by this process, returns the number of refreshed skus
+func (r *CacheRepo) refreshInBackground(staleSkus []string) uint64 {
+	var skus []string
+	for _, sku := range staleSkus {
+		if _, loaded := r.refreshing.LoadOrStore(sku, struct{}{}); !loaded {
+			skus = append(skus, sku)
+		}
+	}
+	if len(skus) == 0 {
+		return 0
+	}
+
+	r.refreshWg.Add(1)
+	go func() {
+		defer r.refreshWg.Done()
+		defer func() {
+			for _, sku := range skus {
+				r.refreshing.Delete(sku)
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+
+		if err := r.refreshProducts(ctx, skus); err != nil {
+			log.Println("[ERROR] refresh products:", err)
+		}
+	}()
+	return uint64(len(skus))
+}
+
+// Close waits for the background refreshes, it must be called before closing the memcached client
+func (r *CacheRepo) Close() {
+	r.refreshWg.Wait()
+}
+
+// refreshProducts replaces the cached values by the rows in the database.
+// The cas is got before reading the database, so the new values are not stored
+// when the keys are invalidated or refreshed by another process in between
+func (r *CacheRepo) refreshProducts(ctx context.Context, skus []string) error {
+	pipe := r.newPipeline(ctx)
+	defer pipe.Finish()
+
+	keys := mapSlice(skus, r.productKey)
+	leaseFnList := mapSlice(keys, func(k ProductCacheKey) memproxy.LeaseGetResult {
+		return pipe.LeaseGet(k.String(), memproxy.LeaseGetOptions{})
 	})
+
+	casList := make([]uint64, 0, len(keys))
+	var refreshKeys []ProductCacheKey
+	for i, fn := range leaseFnList {
+		resp, err := fn.Result()
+		if err != nil {
+			return withErrorKind(errKindMemcached, err)
+		}
+		if resp.Status == memproxy.LeaseGetStatusLeaseRejected {
+			// another client is filling the key
+			continue
+		}
+		casList = append(casList, resp.CAS)
+		refreshKeys = append(refreshKeys, keys[i])
+	}
+	if len(refreshKeys) == 0 {
+		return nil
+	}
+
+	products, err := r.getProductsForCache(ctx, refreshKeys)
+	if err != nil {
+		return err
+	}
+	productMap := make(map[string]*pb.Product, len(products))
+	for _, p := range products {
+		productMap[p.Sku] = p
+	}
+
+	freshUntil := time.Now().Add(r.options.softTTL)
+	setFnList := make([]func() (memproxy.LeaseSetResponse, error), 0, len(refreshKeys))
+	for i, k := range refreshKeys {
+		v := ProductCacheValue{format: r.options.format}
+		if p, ok := productMap[k.Sku]; ok {
+			v.Found = true
+			v.Data = r.cachedProduct(p)
+			v.FreshUntil = freshUntil
+		}
+
+		data, err := v.Marshal()
+		if err != nil {
+			return err
+		}
+		setFnList = append(setFnList, pipe.LeaseSet(k.String(), data, casList[i], memproxy.LeaseSetOptions{}))
+	}
+
+	for _, fn := range setFnList {
+		if _, err := fn(); err != nil {
+			return withErrorKind(errKindMemcached, err)
+		}
+	}
+	return nil
 }
 
 type ProductContent struct {
@@ -106,49 +450,167 @@ func (r *CacheRepo) getProductsForCache(ctx context.Context, keys []ProductCache
 		return k.Sku
 	})
 
-	query := `
-SELECT sku, content FROM products WHERE sku IN (?)
-`
-	query, args, err := sqlx.In(query, skus)
+	result, err := r.store.GetProducts(ctx, skus)
 	if err != nil {
 		return nil, err
 	}
+	return decodeProductContents(result)
+}
 
-	var result []ProductContent
-	err = r.db.SelectContext(ctx, &result, query, args...)
+func (r *CacheRepo) getProductValuesForCache(ctx context.Context, keys []ProductCacheKey) ([]ProductCacheValue, error) {
+	products, err := r.getProductsForCache(ctx, keys)
 	if err != nil {
 		return nil, err
 	}
-	return mapSlice(result, func(p ProductContent) *pb.Product {
+	return mapSlice(products, func(p *pb.Product) ProductCacheValue {
+		return ProductCacheValue{Found: true, Data: r.cachedProduct(p)}
+	}), nil
+}
+
+func decodeProductContents(contents []ProductContent) ([]*pb.Product, error) {
+	result := make([]*pb.Product, 0, len(contents))
+	for _, p := range contents {
 		var product pb.Product
 		err := json.Unmarshal(p.Content, &product)
 		if err != nil {
-			panic(err)
+			return nil, withErrorKind(errKindDecode, fmt.Errorf("decode product '%s': %w", p.Sku, err))
 		}
 
 		product.Sku = p.Sku
-		return &product
-	}), nil
+		result = append(result, &product)
+	}
+	return result, nil
 }
 
-func (r *CacheRepo) InsertProducts(ctx context.Context, products []*pb.Product) {
-	contents := mapSlice(products, func(p *pb.Product) ProductContent {
+func newProductContents(products []*pb.Product) ([]ProductContent, error) {
+	contents := make([]ProductContent, 0, len(products))
+	for _, p := range products {
 		data, err := json.Marshal(p)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		return ProductContent{
+		contents = append(contents, ProductContent{
 			Sku:     p.Sku,
 			Content: data,
-		}
+		})
+	}
+	return contents, nil
+}
+
+func productSkus(products []*pb.Product) []string {
+	return mapSlice(products, func(p *pb.Product) string {
+		return p.Sku
 	})
+}
 
-	query := `
-INSERT INTO products (sku, content)
-VALUES (:sku, :content)
-`
-	_, err := r.db.NamedExecContext(ctx, query, contents)
+// InsertProducts inserts new products and their brands and attributes,
+// the tombstones cached for their skus are deleted when the repo has a cache client
+func (r *CacheRepo) InsertProducts(ctx context.Context, products []*pb.Product) error {
+	contents, err := newProductContents(products)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	if err := r.store.InsertProducts(ctx, contents); err != nil {
+		return err
+	}
+	if err := r.upsertProductEntities(ctx, products); err != nil {
+		return err
+	}
+
+	if r.client == nil {
+		return nil
+	}
+	if err := r.invalidateProductEntities(ctx, products); err != nil {
+		return err
+	}
+	return r.invalidateProducts(ctx, productSkus(products))
+}
+
+// UpsertProducts inserts or replaces the products and their brands and attributes then deletes the cached values
+func (r *CacheRepo) UpsertProducts(ctx context.Context, products []*pb.Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+
+	contents, err := newProductContents(products)
+	if err != nil {
+		return err
+	}
+
+	if err := r.store.UpsertProducts(ctx, contents); err != nil {
+		return err
+	}
+	if err := r.upsertProductEntities(ctx, products); err != nil {
+		return err
+	}
+	if err := r.invalidateProductEntities(ctx, products); err != nil {
+		return err
+	}
+	return r.invalidateProducts(ctx, productSkus(products))
+}
+
+// DeleteProducts deletes the products then deletes the cached values, the next reads cache tombstones
+func (r *CacheRepo) DeleteProducts(ctx context.Context, skus []string) error {
+	if len(skus) == 0 {
+		return nil
+	}
+	if err := r.store.DeleteProducts(ctx, skus); err != nil {
+		return err
+	}
+	return r.invalidateProducts(ctx, skus)
+}
+
+// UpdateProducts updates the products in the database then deletes the cached values,
+// the brands and attributes tables are not changed
+func (r *CacheRepo) UpdateProducts(ctx context.Context, products []*pb.Product) error {
+	if err := r.store.UpdateProducts(ctx, products); err != nil {
+		return err
+	}
+	return r.invalidateProducts(ctx, productSkus(products))
+}
+
+// invalidateProducts deletes the cached values of every format and model after the database is changed.
+// The delete also invalidates the leases granted before it, so a concurrent fill
+// that read the old rows can not set them back into the cache.
+// The in-process cache is only invalidated locally, other processes see the change after the l1 TTL
+func (r *CacheRepo) invalidateProducts(ctx context.Context, skus []string) error {
+	pipe := r.client.Pipeline(ctx)
+	defer pipe.Finish()
+
+	var fnList []func() (memproxy.DeleteResponse, error)
+	for _, sku := range skus {
+		for _, key := range r.productKeyVariants(sku) {
+			fnList = append(fnList, pipe.Delete(key.String(), memproxy.DeleteOptions{}))
+		}
+	}
+	for _, fn := range fnList {
+		if _, err := fn(); err != nil {
+			return withErrorKind(errKindMemcached, err)
+		}
+	}
+
+	if r.options.l1 != nil {
+		for _, sku := range skus {
+			r.options.l1.delete(sku)
+		}
+	}
+	return nil
+}
+
+// invalidateProductEntities deletes the cached brands and attributes of the products in every format,
+// also for the denormalized model, its writes change the entity tables read by the normalized model
+func (r *CacheRepo) invalidateProductEntities(ctx context.Context, products []*pb.Product) error {
+	pipe := r.client.Pipeline(ctx)
+	defer pipe.Finish()
+
+	brands, attributes := productEntities(products)
+	fnList := r.brands.deleteKeys(pipe, brandIDs(brands))
+	fnList = append(fnList, r.attributes.deleteKeys(pipe, attributeIDs(attributes))...)
+	for _, fn := range fnList {
+		if _, err := fn(); err != nil {
+			return withErrorKind(errKindMemcached, err)
+		}
 	}
+	return nil
 }
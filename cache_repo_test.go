@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/QuangTung97/memproxy/fake"
+
+	"bench-multiget/pb"
+)
+
+// memoryStore stands in for mysql in the tests of the cache side
+type memoryStore struct {
+	mut      sync.Mutex
+	products map[string][]byte
+	entities map[string]map[int64][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		products: map[string][]byte{},
+		entities: map[string]map[int64][]byte{},
+	}
+}
+
+func (s *memoryStore) GetProducts(_ context.Context, skus []string) ([]ProductContent, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	var result []ProductContent
+	for _, sku := range skus {
+		if content, ok := s.products[sku]; ok {
+			result = append(result, ProductContent{Sku: sku, Content: content})
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStore) InsertProducts(_ context.Context, contents []ProductContent) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for _, c := range contents {
+		if _, existed := s.products[c.Sku]; existed {
+			return withErrorKind(errKindMySQL, fmt.Errorf("duplicate sku '%s'", c.Sku))
+		}
+	}
+	for _, c := range contents {
+		s.products[c.Sku] = c.Content
+	}
+	return nil
+}
+
+func (s *memoryStore) UpsertProducts(_ context.Context, contents []ProductContent) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for _, c := range contents {
+		s.products[c.Sku] = c.Content
+	}
+	return nil
+}
+
+func (s *memoryStore) UpdateProducts(_ context.Context, products []*pb.Product) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for _, p := range products {
+		if _, existed := s.products[p.Sku]; !existed {
+			continue
+		}
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		s.products[p.Sku] = data
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteProducts(_ context.Context, skus []string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for _, sku := range skus {
+		delete(s.products, sku)
+	}
+	return nil
+}
+
+func (s *memoryStore) GetEntities(_ context.Context, table string, ids []int64) ([]entityContent, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	var result []entityContent
+	for _, id := range ids {
+		if content, ok := s.entities[table][id]; ok {
+			result = append(result, entityContent{ID: id, Content: content})
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStore) UpsertEntities(_ context.Context, table string, contents []entityContent) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.entities[table] == nil {
+		s.entities[table] = map[int64][]byte{}
+	}
+	for _, c := range contents {
+		s.entities[table][c.ID] = c.Content
+	}
+	return nil
+}
+
+func newCacheRepoTest(_ *testing.T, options ...CacheRepoOption) *CacheRepo {
+	return newCacheRepo(newMemoryStore(), fake.New(), options...)
+}
+
+func getProductName(t *testing.T, repo *CacheRepo, sku string) (string, BatchStats) {
+	t.Helper()
+
+	products, stats, err := repo.GetProducts(context.Background(), []string{sku})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if products[0] == nil {
+		return "", stats
+	}
+	return products[0].Name, stats
+}
+
+func TestCacheRepo_ReadAfterWrite(t *testing.T) {
+	repo := newCacheRepoTest(t)
+	ctx := context.Background()
+
+	const sku = "TEST-READ-AFTER-WRITE"
+
+	expectName := func(expected string, hit bool) {
+		t.Helper()
+		name, stats := getProductName(t, repo, sku)
+		if name != expected {
+			t.Errorf("expected name '%s', got '%s'", expected, name)
+		}
+		if (stats.HitCount == 1) != hit {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+	}
+
+	// not found, cached as a tombstone
+	expectName("", false)
+	expectName("", true)
+
+	if err := repo.UpsertProducts(ctx, []*pb.Product{{Sku: sku, Name: "v1"}}); err != nil {
+		t.Fatal(err)
+	}
+	expectName("v1", false)
+	expectName("v1", true)
+
+	if err := repo.UpsertProducts(ctx, []*pb.Product{{Sku: sku, Name: "v2"}}); err != nil {
+		t.Fatal(err)
+	}
+	expectName("v2", false)
+
+	if err := repo.UpdateProducts(ctx, []*pb.Product{{Sku: sku, Name: "v3"}}); err != nil {
+		t.Fatal(err)
+	}
+	expectName("v3", false)
+	expectName("v3", true)
+
+	if err := repo.DeleteProducts(ctx, []string{sku}); err != nil {
+		t.Fatal(err)
+	}
+	expectName("", false)
+	expectName("", true)
+}
+
+func TestCacheRepo_InvalidateOtherFormats(t *testing.T) {
+	store := newMemoryStore()
+	client := fake.New()
+	ctx := context.Background()
+
+	writer := newCacheRepo(store, client)
+	readers := map[string]*CacheRepo{
+		"json+zstd":  newCacheRepo(store, client, WithCodec(jsonCodec[*pb.Product]{}), WithCompression(zstdCompressor{})),
+		"normalized": newCacheRepo(store, client, WithNormalizedModel()),
+	}
+
+	p := newProduct(0)
+	p.Sku = "TEST-INVALIDATE-FORMATS"
+	if err := writer.UpsertProducts(ctx, []*pb.Product{p}); err != nil {
+		t.Fatal(err)
+	}
+	for _, reader := range readers {
+		getProductName(t, reader, p.Sku)
+	}
+
+	p.Name = "v2"
+	p.Brand.Name = "brand v2"
+	if err := writer.UpsertProducts(ctx, []*pb.Product{p}); err != nil {
+		t.Fatal(err)
+	}
+	for name, reader := range readers {
+		products, _, err := reader.GetProducts(ctx, []string{p.Sku})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if products[0].Name != "v2" || products[0].Brand.Name != "brand v2" {
+			t.Errorf("%s: expected the new product, got '%s' '%s'", name, products[0].Name, products[0].Brand.Name)
+		}
+	}
+}
+
+func TestCacheRepo_StaleWhileRevalidate(t *testing.T) {
+	repo := newCacheRepoTest(t, WithSoftTTL(10*time.Millisecond))
+	ctx := context.Background()
+
+	const sku = "TEST-STALE-WHILE-REVALIDATE"
+	if err := repo.UpsertProducts(ctx, []*pb.Product{{Sku: sku, Name: "v1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	getProductName(t, repo, sku)
+
+	// change the database without invalidating the cache
+	if err := repo.store.UpdateProducts(ctx, []*pb.Product{{Sku: sku, Name: "v2"}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	name, stats := getProductName(t, repo, sku)
+	if name != "v1" || stats.StaleServeCount != 1 || stats.RefreshCount != 1 {
+		t.Fatalf("the stale value must be served and refreshed, name: '%s', stats: %+v", name, stats)
+	}
+
+	repo.Close()
+
+	name, stats = getProductName(t, repo, sku)
+	if name != "v2" || stats.HitCount != 1 || stats.StaleServeCount != 0 {
+		t.Errorf("the refreshed value must be served from the cache, name: '%s', stats: %+v", name, stats)
+	}
+}
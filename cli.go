@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/QuangTung97/memproxy/proxy"
+	"github.com/jmoiron/sqlx"
+)
+
+const usage = `Usage: bench-multiget <command> [flags]
+
+Commands:
+  migrate          create the products, brands, attributes and product_deletes tables,
+                   and the (updated_at, sku) index of the products
+  seed             insert generated products into MySQL
+  sync-es          rebuild the elasticsearch index from MySQL, then switch the readers to it,
+                   or sync the changes since the last sync with -incremental
+  bench cache      benchmark multi get from memcached (memproxy)
+  bench elastic    benchmark multi get from elasticsearch
+  scenario         run every combination of a scenario file (TOML)
+  compare          compare result sets from the history store or json lines files
+
+Run 'bench-multiget <command> -h' for the flags of each command.
+`
+
+const (
+	backendCache   = "cache"
+	backendElastic = "elastic"
+)
+
+type benchConfig struct {
+	DSN string
+
+	MemcachedServers string
+	MemcachedConns   int
+
+	// Topology is how the keys are distributed between the memcached servers
+	Topology string
+
+	// Model is whether the brands and attributes are cached embedded in the products or separately
+	Model string
+
+	// TTL is the expiry of the cached products, SoftTTL is the age after which they are
+	// still served but refreshed in the background. NegativeTTL is the expiry of the tombstones cached for not existing skus
+	TTL         time.Duration
+	SoftTTL     time.Duration
+	NegativeTTL time.Duration
+
+	// KeyNamespace and KeyVersion are the prefix of the cache keys,
+	// KeyVersion "auto" is derived from the proto descriptor of the product and the cached value layout
+	KeyNamespace string
+	KeyVersion   string
+
+	// Codec and Compression are the encoding of the cached products
+	Codec       string
+	Compression string
+
+	// L1Policy enables an in-process cache in front of memcached, with at most L1Size products
+	L1Policy string
+	L1Size   int
+	L1TTL    time.Duration
+
+	ESAddr string
+
+	// ESMethod is the API used to get the products: a terms search, or a multi get by id
+	ESMethod string
+
+	// ESProjection is the part of the documents returned: "source", or "<kind>:<fields>"
+	// with kind one of includes, excludes, docvalue or stored, e.g. "excludes:attributes"
+	ESProjection string
+
+	// ESDecoder is the decoder of the responses
+	ESDecoder string
+
+	NumProducts     int
+	NumThreads      int
+	NumSkusPerBatch int
+	NumLoops        int
+
+	Keys keyDistConfig
+
+	// Rate is the target number of keys per second, zero means closed loop mode
+	Rate float64
+
+	// WriteRatio is the fraction of operations updating a product instead of a multi get
+	WriteRatio float64
+
+	// Duration of the measured phase, when set NumLoops is ignored
+	Duration time.Duration
+	Warmup   time.Duration
+	Cooldown time.Duration
+}
+
+func defaultBenchConfig() benchConfig {
+	return benchConfig{
+		DSN: "root:1@tcp(localhost:3306)/bench?parseTime=true",
+
+		MemcachedServers: "localhost:11211",
+		MemcachedConns:   4,
+		Topology:         topologyReplicated,
+		Model:            modelDenormalized,
+		NegativeTTL:      30 * time.Second,
+		KeyNamespace:     "bench",
+		KeyVersion:       keyVersionAuto,
+		Codec:            codecGogo,
+		Compression:      compressionNone,
+		L1Policy:         l1PolicyNone,
+		L1Size:           1000,
+		L1TTL:            10 * time.Second,
+
+		ESAddr:       "http://localhost:9200",
+		ESMethod:     esMethodSearch,
+		ESProjection: esProjectionSource,
+		ESDecoder:    esDecoderJSONIter,
+
+		NumProducts:     numProducts,
+		NumThreads:      8,
+		NumSkusPerBatch: 40,
+		NumLoops:        10_000,
+
+		Keys: defaultKeyDistConfig(),
+	}
+}
+
+func (c *benchConfig) registerDBFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.DSN, "dsn", c.DSN, "MySQL data source name")
+}
+
+func (c *benchConfig) registerBenchFlags(fs *flag.FlagSet) {
+	c.registerDBFlags(fs)
+	fs.IntVar(&c.NumProducts, "products", c.NumProducts,
+		"number of products in the key space, skus above the seeded products are not found")
+	fs.IntVar(&c.NumThreads, "threads", c.NumThreads, "number of client goroutines")
+	fs.IntVar(&c.NumSkusPerBatch, "batch", c.NumSkusPerBatch, "number of skus per multi get")
+	fs.IntVar(&c.NumLoops, "loops", c.NumLoops, "number of measured multi gets per thread, ignored when -duration is set")
+	fs.Float64Var(&c.WriteRatio, "write-ratio", c.WriteRatio,
+		"fraction of operations updating a product in MySQL and invalidating the cache / re-indexing")
+	fs.DurationVar(&c.Duration, "duration", c.Duration, "wall clock time of the measured phase")
+	fs.DurationVar(&c.Warmup, "warmup", c.Warmup, "warmup phase before the measured phase, excluded from statistics")
+	fs.DurationVar(&c.Cooldown, "cooldown", c.Cooldown,
+		"cooldown phase after the measured phase, excluded from statistics, requires -duration")
+	fs.StringVar(&c.Keys.Distribution, "dist", c.Keys.Distribution,
+		"key access distribution: sequential (random aligned range), uniform, zipf, hotspot")
+	fs.Float64Var(&c.Keys.ZipfS, "zipf-s", c.Keys.ZipfS, "s parameter of the zipf distribution, must be > 1")
+	fs.Float64Var(&c.Keys.HotKeys, "hot-keys", c.Keys.HotKeys, "fraction of keys in the hot set of the hotspot distribution")
+	fs.Float64Var(&c.Keys.HotRatio, "hot-ratio", c.Keys.HotRatio,
+		"fraction of accesses going to the hot set of the hotspot distribution")
+	fs.Float64Var(&c.Rate, "rate", c.Rate,
+		"target keys per second, enables open loop mode with latency measured from the scheduled send time")
+}
+
+func (c *benchConfig) registerMemcachedFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.MemcachedServers, "memcached", c.MemcachedServers, "comma separated list of memcached host:port")
+	fs.IntVar(&c.MemcachedConns, "conns", c.MemcachedConns, "number of connections per memcached server")
+	fs.StringVar(&c.Topology, "topology", c.Topology,
+		"distribution of the keys between the memcached servers: "+
+			"replicated (every server has every key) or hash (sharded by consistent hashing)")
+	fs.DurationVar(&c.TTL, "ttl", c.TTL, "TTL of the cached products, zero means no expiry")
+	fs.DurationVar(&c.SoftTTL, "soft-ttl", c.SoftTTL,
+		"age after which cached products are served stale and refreshed in the background, zero disables it")
+	fs.DurationVar(&c.NegativeTTL, "negative-ttl", c.NegativeTTL,
+		"TTL of the tombstones cached for not found skus, zero means no expiry")
+	fs.StringVar(&c.Model, "model", c.Model,
+		"cached model: denormalized (products embed their brand and attributes) "+
+			"or normalized (brands and attributes cached once per id, needs the seed of this version)")
+	fs.StringVar(&c.KeyNamespace, "key-namespace", c.KeyNamespace, "namespace of the cache keys, empty for no namespace")
+	fs.StringVar(&c.KeyVersion, "key-version", c.KeyVersion,
+		"schema version of the cache keys, '"+keyVersionAuto+"' derives it from the product proto descriptor and the value layout, empty for unversioned keys")
+	fs.StringVar(&c.Codec, "codec", c.Codec, "codec of the cached products: "+strings.Join(codecNames, ", ")+
+		" (protov2 and vtproto use the protoc-gen-go types of pb/pbgo, the copy from the gogo types is included)")
+	fs.StringVar(&c.Compression, "compression", c.Compression,
+		"compression of the cached products: "+strings.Join(compressionNames, ", "))
+	fs.StringVar(&c.L1Policy, "l1", c.L1Policy,
+		"eviction policy of the in-process cache in front of memcached: "+strings.Join(l1PolicyNames, ", "))
+	fs.IntVar(&c.L1Size, "l1-size", c.L1Size, "max number of products in the in-process cache")
+	fs.DurationVar(&c.L1TTL, "l1-ttl", c.L1TTL, "TTL of the in-process cache entries, zero means no expiry")
+}
+
+func (c *benchConfig) registerElasticFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ESAddr, "es", c.ESAddr, "elasticsearch address")
+	fs.StringVar(&c.ESMethod, "es-method", c.ESMethod,
+		"api used to get the products: "+strings.Join(esMethodNames, ", "))
+	fs.StringVar(&c.ESProjection, "es-projection", c.ESProjection,
+		"part of the documents returned: source, or <kind>:<field>,... with kind one of "+
+			strings.Join(esProjectionKinds[1:], ", "))
+	fs.StringVar(&c.ESDecoder, "es-decoder", c.ESDecoder,
+		"decoder of the responses: "+strings.Join(esDecoderNames, ", "))
+}
+
+func (c *benchConfig) validate() error {
+	if c.NumThreads <= 0 {
+		return errors.New("threads must be positive")
+	}
+	if c.NumSkusPerBatch <= 0 || c.NumSkusPerBatch > c.NumProducts {
+		return fmt.Errorf("batch must be in range [1, %d]", c.NumProducts)
+	}
+	if c.Duration < 0 || c.Warmup < 0 || c.Cooldown < 0 {
+		return errors.New("duration, warmup and cooldown must not be negative")
+	}
+	if c.Duration == 0 && c.NumLoops <= 0 {
+		return errors.New("loops must be positive")
+	}
+	if c.Duration == 0 && c.Cooldown > 0 {
+		return errors.New("cooldown requires duration")
+	}
+	if err := c.Keys.validate(); err != nil {
+		return err
+	}
+	if c.WriteRatio < 0 || c.WriteRatio > 1 {
+		return errors.New("write ratio must be in range [0, 1]")
+	}
+	if err := validateCodecName(c.Codec); err != nil {
+		return err
+	}
+	if err := validateCompressionName(c.Compression); err != nil {
+		return err
+	}
+	if err := validateTopology(c.Topology); err != nil {
+		return err
+	}
+	if err := validateModel(c.Model); err != nil {
+		return err
+	}
+	if err := validateESMethod(c.ESMethod); err != nil {
+		return err
+	}
+	if err := validateESProjection(c.ESProjection, c.ESMethod); err != nil {
+		return err
+	}
+	if err := validateESDecoder(c.ESDecoder); err != nil {
+		return err
+	}
+	if err := validateKeyPrefix(c.KeyNamespace, c.KeyVersion); err != nil {
+		return err
+	}
+	if err := validateL1Policy(c.L1Policy); err != nil {
+		return err
+	}
+	if c.L1Policy != l1PolicyNone && (c.L1Size <= 0 || c.L1TTL < 0) {
+		return errors.New("l1 size must be positive and l1 ttl must not be negative")
+	}
+	if c.TTL < 0 || c.SoftTTL < 0 || c.NegativeTTL < 0 {
+		return errors.New("ttl, soft ttl and negative ttl must not be less than zero")
+	}
+	if c.TTL > 0 && c.SoftTTL >= c.TTL {
+		return errors.New("soft ttl must be less than ttl")
+	}
+	if c.Rate < 0 {
+		return errors.New("rate must not be negative")
+	}
+	return nil
+}
+
+// parseMemcachedServers parses a comma separated list of host:port
+func parseMemcachedServers(s string) ([]proxy.SimpleServerConfig, error) {
+	var servers []proxy.SimpleServerConfig
+	for i, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		host, portStr, found := strings.Cut(addr, ":")
+		if !found {
+			portStr = "11211"
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memcached address '%s': %w", addr, err)
+		}
+
+		servers = append(servers, proxy.SimpleServerConfig{
+			ID:   proxy.ServerID(i + 1),
+			Host: host,
+			Port: uint16(port),
+		})
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("empty memcached server list")
+	}
+	return servers, nil
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+func runCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return errors.New("missing command")
+	}
+
+	switch args[0] {
+	case "migrate":
+		return runMigrate(args[1:])
+	case "seed":
+		return runSeed(args[1:])
+	case "sync-es":
+		return runSyncElastic(args[1:])
+	case "bench":
+		return runBench(args[1:])
+	case "scenario":
+		return runScenarioCommand(args[1:])
+	case "compare":
+		return runCompare(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command '%s'", args[0])
+	}
+}
+
+func runMigrate(args []string) error {
+	conf := defaultBenchConfig()
+	fs := newFlagSet("migrate")
+	conf.registerDBFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db := sqlx.MustConnect("mysql", conf.DSN)
+	doMigrate(db)
+	return nil
+}
+
+func runSeed(args []string) error {
+	conf := defaultBenchConfig()
+	fs := newFlagSet("seed")
+	conf.registerDBFlags(fs)
+	fs.IntVar(&conf.NumProducts, "products", conf.NumProducts, "number of products to insert")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db := sqlx.MustConnect("mysql", conf.DSN)
+	return insertProducts(db, conf.NumProducts)
+}
+
+func runSyncElastic(args []string) error {
+	conf := defaultBenchConfig()
+	fs := newFlagSet("sync-es")
+	conf.registerDBFlags(fs)
+	conf.registerElasticFlags(fs)
+	keepVersions := fs.Int("keep-versions", 1, "number of previous index versions kept after the alias switch")
+	incremental := fs.Bool("incremental", false,
+		"sync the products changed or deleted since the last sync, instead of rebuilding the index")
+	interval := fs.Duration("interval", 0,
+		"run the incremental sync continuously with this interval between passes, zero means a single pass")
+	settle := fs.Duration("settle", 2*time.Second,
+		"age of the changes before the incremental sync reads them, covering the commits late in the same second")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keepVersions < 0 {
+		return errors.New("keep versions must not be negative")
+	}
+	if *interval < 0 || *settle < 0 {
+		return errors.New("interval and settle must not be negative")
+	}
+	if *interval > 0 && !*incremental {
+		return errors.New("interval requires incremental")
+	}
+
+	db := sqlx.MustConnect("mysql", conf.DSN)
+	repo, err := NewElasticRepo(db, conf.ESAddr)
+	if err != nil {
+		return err
+	}
+	if !*incremental {
+		return repo.SyncProducts(*keepVersions, *settle)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return repo.SyncIncremental(ctx, *settle, *interval)
+}
+
+func runBench(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing bench backend, must be one of: cache, elastic")
+	}
+	backend := args[0]
+
+	conf, err := defaultBackendConfig(backend)
+	if err != nil {
+		return err
+	}
+
+	fs := newFlagSet("bench " + backend)
+	conf.registerBenchFlags(fs)
+
+	if backend == backendCache {
+		conf.registerMemcachedFlags(fs)
+	} else {
+		conf.registerElasticFlags(fs)
+	}
+
+	var out outputConfig
+	out.registerFlags(fs)
+
+	var history historyConfig
+	history.registerFlags(fs)
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if err := conf.validate(); err != nil {
+		return err
+	}
+	if err := out.validate(); err != nil {
+		return err
+	}
+
+	db := sqlx.MustConnect("mysql", conf.DSN)
+	r, err := runBackendBench(db, backend, conf)
+	if err != nil {
+		return err
+	}
+	if err := history.save(r); err != nil {
+		return err
+	}
+
+	if out.Format == outputText {
+		r.print()
+		return nil
+	}
+
+	w, err := newResultWriter(out)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = w.Close() }()
+
+	return w.Write(r)
+}
+
+func defaultBackendConfig(backend string) (benchConfig, error) {
+	conf := defaultBenchConfig()
+	switch backend {
+	case backendCache:
+	case backendElastic:
+		conf.NumThreads = 10
+		conf.NumSkusPerBatch = 20
+	default:
+		return benchConfig{}, fmt.Errorf("unknown bench backend '%s', must be one of: cache, elastic", backend)
+	}
+	return conf, nil
+}
+
+func runBackendBench(db *sqlx.DB, backend string, conf benchConfig) (benchResult, error) {
+	if backend == backendCache {
+		return benchMultiGetFromCache(db, conf)
+	}
+	return benchMultiGetFromElastic(db, conf)
+}
+
+func runScenarioCommand(args []string) error {
+	fs := newFlagSet("scenario")
+
+	var out outputConfig
+	out.registerFlags(fs)
+
+	var history historyConfig
+	history.registerFlags(fs)
+
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: bench-multiget scenario [flags] <file.toml>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := out.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("missing scenario file")
+	}
+
+	s, err := loadScenarioFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return runScenario(s, out, history)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	protov2 "google.golang.org/protobuf/proto"
+)
+
+// Codec encodes the entities stored in the cache, the id is written in the header of every cached value
+type Codec[T any] interface {
+	ID() byte
+	Name() string
+	Marshal(v T) ([]byte, error)
+	Unmarshal(data []byte, v T) error
+}
+
+const (
+	codecGogo    = "gogo"
+	codecJSON    = "json"
+	codecMsgpack = "msgpack"
+	codecProtoV2 = "protov2"
+	codecVTProto = "vtproto"
+)
+
+var codecNames = []string{codecGogo, codecJSON, codecMsgpack, codecProtoV2, codecVTProto}
+
+// codec ids start from 1, the value 0 is used by the tombstones
+const (
+	codecIDGogo byte = iota + 1
+	codecIDJSON
+	codecIDMsgpack
+	codecIDProtoV2
+	codecIDVTProto
+)
+
+func validateCodecName(name string) error {
+	for _, n := range codecNames {
+		if n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown codec '%s', must be one of: %s", name, strings.Join(codecNames, ", "))
+}
+
+func newCodec[T ProtoMessage](name string) (Codec[T], error) {
+	switch name {
+	case codecGogo:
+		return gogoCodec[T]{}, nil
+	case codecJSON:
+		return jsonCodec[T]{}, nil
+	case codecMsgpack:
+		return msgpackCodec[T]{}, nil
+	case codecProtoV2:
+		return protoV2Codec[T]{}, nil
+	case codecVTProto:
+		return vtprotoCodec[T]{}, nil
+	default:
+		return nil, validateCodecName(name)
+	}
+}
+
+func codecByID[T ProtoMessage](id byte) (Codec[T], error) {
+	switch id {
+	case codecIDGogo:
+		return gogoCodec[T]{}, nil
+	case codecIDJSON:
+		return jsonCodec[T]{}, nil
+	case codecIDMsgpack:
+		return msgpackCodec[T]{}, nil
+	case codecIDProtoV2:
+		return protoV2Codec[T]{}, nil
+	case codecIDVTProto:
+		return vtprotoCodec[T]{}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec id %d", id)
+	}
+}
+
+// gogoCodec uses the methods generated by protoc-gen-gogo (gofast)
+type gogoCodec[T ProtoMessage] struct {
+}
+
+func (gogoCodec[T]) ID() byte     { return codecIDGogo }
+func (gogoCodec[T]) Name() string { return codecGogo }
+
+func (gogoCodec[T]) Marshal(v T) ([]byte, error) {
+	return v.Marshal()
+}
+
+func (gogoCodec[T]) Unmarshal(data []byte, v T) error {
+	return v.Unmarshal(data)
+}
+
+type jsonCodec[T any] struct {
+}
+
+func (jsonCodec[T]) ID() byte     { return codecIDJSON }
+func (jsonCodec[T]) Name() string { return codecJSON }
+
+func (jsonCodec[T]) Marshal(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec[T]) Unmarshal(data []byte, v T) error {
+	return json.Unmarshal(data, v)
+}
+
+// msgpackCodec uses the json struct tags, so the XXX_ fields of the generated types are skipped
+type msgpackCodec[T any] struct {
+}
+
+func (msgpackCodec[T]) ID() byte     { return codecIDMsgpack }
+func (msgpackCodec[T]) Name() string { return codecMsgpack }
+
+func (msgpackCodec[T]) Marshal(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec[T]) Unmarshal(data []byte, v T) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// protoV2Codec uses the types generated by protoc-gen-go with the google.golang.org/protobuf runtime.
+// The entities are copied from and into the gogo types, the copy is included in the decode time
+type protoV2Codec[T any] struct {
+}
+
+func (protoV2Codec[T]) ID() byte     { return codecIDProtoV2 }
+func (protoV2Codec[T]) Name() string { return codecProtoV2 }
+
+func (protoV2Codec[T]) Marshal(v T) ([]byte, error) {
+	return protov2.Marshal(toPbgo(v))
+}
+
+func (protoV2Codec[T]) Unmarshal(data []byte, v T) error {
+	m := newPbgo(v)
+	if err := protov2.Unmarshal(data, m); err != nil {
+		return err
+	}
+	fromPbgo(m, v)
+	return nil
+}
+
+// vtprotoCodec uses the methods generated by protoc-gen-go-vtproto for the protoc-gen-go types,
+// the entities are copied like protoV2Codec
+type vtprotoCodec[T any] struct {
+}
+
+func (vtprotoCodec[T]) ID() byte     { return codecIDVTProto }
+func (vtprotoCodec[T]) Name() string { return codecVTProto }
+
+func (vtprotoCodec[T]) Marshal(v T) ([]byte, error) {
+	return toPbgo(v).MarshalVT()
+}
+
+func (vtprotoCodec[T]) Unmarshal(data []byte, v T) error {
+	m := newPbgo(v)
+	if err := m.UnmarshalVT(data); err != nil {
+		return err
+	}
+	fromPbgo(m, v)
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+
+	protov2 "google.golang.org/protobuf/proto"
+
+	"bench-multiget/pb"
+	"bench-multiget/pb/pbgo"
+)
+
+// pbgoMessage is a type generated by protoc-gen-go and protoc-gen-go-vtproto in pb/pbgo,
+// from a copy of cache.proto under another package
+type pbgoMessage interface {
+	protov2.Message
+	MarshalVT() ([]byte, error)
+	UnmarshalVT(data []byte) error
+}
+
+// toPbgo copies a gogo entity into its pbgo type, the strings are shared
+func toPbgo(v any) pbgoMessage {
+	switch v := v.(type) {
+	case *pb.Product:
+		return productToPbgo(v)
+	case *pb.Brand:
+		return brandToPbgo(v)
+	case *pb.Attribute:
+		return attributeToPbgo(v)
+	default:
+		panic(fmt.Sprintf("no pbgo type for %T", v))
+	}
+}
+
+// newPbgo returns an empty pbgo message of the type of the gogo entity
+func newPbgo(v any) pbgoMessage {
+	switch v.(type) {
+	case *pb.Product:
+		return &pbgo.Product{}
+	case *pb.Brand:
+		return &pbgo.Brand{}
+	case *pb.Attribute:
+		return &pbgo.Attribute{}
+	default:
+		panic(fmt.Sprintf("no pbgo type for %T", v))
+	}
+}
+
+// fromPbgo copies a pbgo message into the gogo entity of the same type, the strings are shared
+func fromPbgo(m pbgoMessage, v any) {
+	switch v := v.(type) {
+	case *pb.Product:
+		*v = *productFromPbgo(m.(*pbgo.Product))
+	case *pb.Brand:
+		*v = *brandFromPbgo(m.(*pbgo.Brand))
+	case *pb.Attribute:
+		*v = *attributeFromPbgo(m.(*pbgo.Attribute))
+	default:
+		panic(fmt.Sprintf("no pbgo type for %T", v))
+	}
+}
+
+func productToPbgo(p *pb.Product) *pbgo.Product {
+	result := &pbgo.Product{
+		Sku:         p.Sku,
+		Name:        p.Name,
+		DisplayName: p.DisplayName,
+		Desc:        p.Desc,
+		Brand:       brandToPbgo(p.Brand),
+	}
+	if len(p.Attributes) > 0 {
+		result.Attributes = mapSlice(p.Attributes, attributeToPbgo)
+	}
+	return result
+}
+
+func productFromPbgo(p *pbgo.Product) *pb.Product {
+	result := &pb.Product{
+		Sku:         p.Sku,
+		Name:        p.Name,
+		DisplayName: p.DisplayName,
+		Desc:        p.Desc,
+		Brand:       brandFromPbgo(p.Brand),
+	}
+	if len(p.Attributes) > 0 {
+		result.Attributes = mapSlice(p.Attributes, attributeFromPbgo)
+	}
+	return result
+}
+
+func brandToPbgo(b *pb.Brand) *pbgo.Brand {
+	if b == nil {
+		return nil
+	}
+	return &pbgo.Brand{Id: b.Id, Code: b.Code, Name: b.Name}
+}
+
+func brandFromPbgo(b *pbgo.Brand) *pb.Brand {
+	if b == nil {
+		return nil
+	}
+	return &pb.Brand{Id: b.Id, Code: b.Code, Name: b.Name}
+}
+
+func attributeToPbgo(a *pb.Attribute) *pbgo.Attribute {
+	if a == nil {
+		return nil
+	}
+	return &pbgo.Attribute{Id: a.Id, Code: a.Code, Name: a.Name}
+}
+
+func attributeFromPbgo(a *pbgo.Attribute) *pb.Attribute {
+	if a == nil {
+		return nil
+	}
+	return &pb.Attribute{Id: a.Id, Code: a.Code, Name: a.Name}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"bench-multiget/pb"
+)
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	product := newProduct(12)
+
+	for _, name := range codecNames {
+		codec, err := newCodec[*pb.Product](name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if codec.Name() != name {
+			t.Errorf("unexpected codec name: %s", codec.Name())
+		}
+
+		data, err := ProductCacheValue{Found: true, Data: product, format: ValueFormat[*pb.Product]{Codec: codec, Compression: noCompressor{}}}.Marshal()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if data[0] != codec.ID() {
+			t.Errorf("%s: unexpected header: %d", name, data[0])
+		}
+
+		var stats DecodeStats
+		v, err := decodeCacheValue(newProductProto, data, &stats)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !v.Found || v.format.Codec.Name() != name {
+			t.Errorf("%s: unexpected value: %+v", name, v)
+		}
+		if !reflect.DeepEqual(v.Data, product) {
+			t.Errorf("%s: decoded product not equal, got %v", name, v.Data)
+		}
+	}
+}
+
+func TestCodecs_PbgoEntities(t *testing.T) {
+	product := newProduct(12)
+	gogoData, err := product.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{codecProtoV2, codecVTProto} {
+		// the same schema, the payloads of gogo are decoded by the protoc-gen-go types
+		productCodec, _ := newCodec[*pb.Product](name)
+		decoded := &pb.Product{}
+		if err := productCodec.Unmarshal(gogoData, decoded); err != nil {
+			t.Fatal(name, err)
+		}
+		if !reflect.DeepEqual(decoded, product) {
+			t.Errorf("%s: gogo payload not decoded, got %v", name, decoded)
+		}
+
+		brandCodec, _ := newCodec[*pb.Brand](name)
+		data, err := brandCodec.Marshal(product.Brand)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		brand := &pb.Brand{}
+		if err := brandCodec.Unmarshal(data, brand); err != nil {
+			t.Fatal(name, err)
+		}
+		if !reflect.DeepEqual(brand, product.Brand) {
+			t.Errorf("%s: unexpected brand: %v", name, brand)
+		}
+	}
+}
+
+func TestValidateCodecName(t *testing.T) {
+	if err := validateCodecName("protobuf"); err == nil {
+		t.Error("expected error for unknown codec")
+	}
+	if err := validateCodecName(codecVTProto); err != nil {
+		t.Error(err)
+	}
+	if err := validateCodecName(codecMsgpack); err != nil {
+		t.Error(err)
+	}
+}
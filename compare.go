@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aclements/go-moremath/stats"
+)
+
+// historyConfig stores every result as a json line into <Dir>/<Label>.jsonl,
+// repeated runs with the same label are the samples compared by the compare command
+type historyConfig struct {
+	Dir   string
+	Label string
+}
+
+func (c *historyConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Dir, "history", c.Dir, "directory of the result history store, empty to disable")
+	fs.StringVar(&c.Label, "label", c.Label,
+		"name of the result set in the history store, defaults to the git commit and memproxy version")
+}
+
+func defaultHistoryLabel(env runEnv) string {
+	commit := env.GitCommit
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if env.MemproxyVersion == "" {
+		return commit
+	}
+	return commit + "-memproxy-" + env.MemproxyVersion
+}
+
+func sanitizeLabel(label string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ' ' || r == ':' {
+			return '_'
+		}
+		return r
+	}, label)
+}
+
+func (c historyConfig) save(r benchResult) error {
+	if c.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return err
+	}
+
+	label := c.Label
+	if label == "" {
+		label = defaultHistoryLabel(r.Env)
+	}
+	file := filepath.Join(c.Dir, sanitizeLabel(label)+".jsonl")
+
+	w, err := newResultWriter(outputConfig{Format: outputJSON, File: file})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = w.Close() }()
+
+	return w.Write(r)
+}
+
+// resolveResultSet returns the path of a result set, which is either a file or a label in the history store
+func resolveResultSet(historyDir string, name string) (string, error) {
+	if _, err := os.Stat(name); err == nil {
+		return name, nil
+	}
+	if historyDir != "" {
+		path := filepath.Join(historyDir, sanitizeLabel(name)+".jsonl")
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("result set '%s' not found", name)
+}
+
+func readResultRecords(r io.Reader) ([]resultRecord, error) {
+	var records []resultRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+
+		var rec resultRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+func loadResultSet(path string) ([]resultRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	records, err := readResultRecords(f)
+	if err != nil {
+		return nil, fmt.Errorf("read result set '%s': %w", path, err)
+	}
+	return records, nil
+}
+
+// orDefaultCodec matches the records stored before the codec was configurable with the gogo ones
+func orDefaultCodec(codec string) string {
+	if codec == "" {
+		return codecGogo
+	}
+	return codec
+}
+
+func orDefaultCompression(compression string) string {
+	if compression == "" {
+		return compressionNone
+	}
+	return compression
+}
+
+func orDefaultL1(policy string) string {
+	if policy == "" {
+		return l1PolicyNone
+	}
+	return policy
+}
+
+func orDefaultTopology(topology string) string {
+	if topology == "" {
+		return topologyReplicated
+	}
+	return topology
+}
+
+// orDefaultESMethod matches the records stored before the mget methods with the search ones
+func orDefaultESMethod(method string) string {
+	if method == "" {
+		return esMethodSearch
+	}
+	return method
+}
+
+// orDefaultESProjection matches the records stored before the projection was configurable with the full _source ones
+func orDefaultESProjection(projection string) string {
+	if projection == "" {
+		return esProjectionSource
+	}
+	return projection
+}
+
+// orDefaultESDecoder matches the records stored before the decoder was configurable with the jsoniter ones
+func orDefaultESDecoder(decoder string) string {
+	if decoder == "" {
+		return esDecoderJSONIter
+	}
+	return decoder
+}
+
+func orDefaultModel(model string) string {
+	if model == "" {
+		return modelDenormalized
+	}
+	return model
+}
+
+// scenarioKey identifies the parameters of a run, runs with the same key are samples of the same scenario
+func (rec resultRecord) scenarioKey() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "backend=%s threads=%d batch=%d", rec.Backend, rec.Threads, rec.Batch)
+	if rec.Backend == backendCache {
+		fmt.Fprintf(&b, " conns=%d topology=%s model=%s codec=%s compression=%s l1=%s",
+			rec.Conns, orDefaultTopology(rec.Topology), orDefaultModel(rec.Model),
+			orDefaultCodec(rec.Codec), orDefaultCompression(rec.Compression), orDefaultL1(rec.L1))
+	}
+	if rec.Backend == backendElastic {
+		fmt.Fprintf(&b, " method=%s projection=%s decoder=%s", orDefaultESMethod(rec.ESMethod),
+			orDefaultESProjection(rec.ESProjection), orDefaultESDecoder(rec.ESDecoder))
+	}
+	fmt.Fprintf(&b, " dist=%s products=%d", rec.Dist, rec.Products)
+	if rec.Rate > 0 {
+		fmt.Fprintf(&b, " rate=%g", rec.Rate)
+	}
+	if rec.WriteRatio > 0 {
+		fmt.Fprintf(&b, " write_ratio=%g", rec.WriteRatio)
+	}
+	if rec.Duration != "" {
+		fmt.Fprintf(&b, " duration=%s", rec.Duration)
+	} else {
+		fmt.Fprintf(&b, " loops=%d", rec.Loops)
+	}
+	fmt.Fprintf(&b, " gogc=%s gomemlimit=%s", rec.GOGC, rec.GOMemLimit)
+	return b.String()
+}
+
+// metric returns the value of the float64 field with the json name
+func (rec resultRecord) metric(name string) (float64, bool) {
+	v := reflect.ValueOf(rec)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("json") != name {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.Float64:
+			return f.Float(), true
+		case reflect.Uint64:
+			return float64(f.Uint()), true
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+type resultSet struct {
+	name    string
+	samples map[string][]float64
+}
+
+func newResultSet(name string, records []resultRecord, metric string) (resultSet, []string, error) {
+	s := resultSet{
+		name:    name,
+		samples: map[string][]float64{},
+	}
+
+	var keys []string
+	for _, rec := range records {
+		v, ok := rec.metric(metric)
+		if !ok {
+			return resultSet{}, nil, fmt.Errorf("unknown numeric metric '%s'", metric)
+		}
+
+		key := rec.scenarioKey()
+		if _, existed := s.samples[key]; !existed {
+			keys = append(keys, key)
+		}
+		s.samples[key] = append(s.samples[key], v)
+	}
+	return s, keys, nil
+}
+
+type sampleSummary struct {
+	n      int
+	mean   float64
+	stdDev float64
+}
+
+func summarize(xs []float64) sampleSummary {
+	s := sampleSummary{
+		n:    len(xs),
+		mean: stats.Mean(xs),
+	}
+	if len(xs) > 1 {
+		s.stdDev = stats.StdDev(xs)
+	}
+	return s
+}
+
+func (s sampleSummary) String() string {
+	if s.n == 0 {
+		return "-"
+	}
+	if s.mean == 0 {
+		return fmt.Sprintf("%.4g (n=%d)", s.mean, s.n)
+	}
+	return fmt.Sprintf("%.4g ±%.1f%% (n=%d)", s.mean, 100*s.stdDev/s.mean, s.n)
+}
+
+type comparison struct {
+	// hasDelta is false when the mean of the baseline is zero, the relative delta is undefined
+	hasDelta    bool
+	delta       float64
+	p           float64
+	significant bool
+}
+
+// compareSamples uses the Mann-Whitney U-test like benchstat, the p-value is 1 when the test can not be done
+func compareSamples(base []float64, other []float64, alpha float64) comparison {
+	c := comparison{p: 1}
+	if baseMean := stats.Mean(base); baseMean != 0 {
+		c.hasDelta = true
+		c.delta = (stats.Mean(other) - baseMean) / baseMean
+	}
+
+	res, err := stats.MannWhitneyUTest(base, other, stats.LocationDiffers)
+	if err == nil {
+		c.p = res.P
+	}
+	c.significant = c.p < alpha
+	return c
+}
+
+func (c comparison) String() string {
+	if !c.hasDelta {
+		return "-"
+	}
+	if !c.significant {
+		return fmt.Sprintf("~ (p=%.3f)", c.p)
+	}
+	return fmt.Sprintf("%+.2f%% (p=%.3f)", 100*c.delta, c.p)
+}
+
+// compareResultSets prints a row per scenario of the baseline (the first set),
+// with the delta of every other set relative to the baseline
+func compareResultSets(out io.Writer, sets []resultSet, keys []string, alpha float64) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+
+	header := []string{"SCENARIO", sets[0].name}
+	for _, s := range sets[1:] {
+		header = append(header, s.name, "DELTA")
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+
+	for _, key := range keys {
+		base := sets[0].samples[key]
+		row := []string{key, summarize(base).String()}
+
+		for _, s := range sets[1:] {
+			samples := s.samples[key]
+			row = append(row, summarize(samples).String())
+			if len(base) == 0 || len(samples) == 0 {
+				row = append(row, "-")
+				continue
+			}
+			row = append(row, compareSamples(base, samples, alpha).String())
+		}
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func runCompare(args []string) error {
+	fs := newFlagSet("compare")
+
+	var historyDir string
+	fs.StringVar(&historyDir, "history", historyDir, "directory of the result history store to resolve labels")
+	metric := fs.String("metric", "gets_per_second",
+		"json name of the compared metric, e.g. gets_per_second, bytes_per_second, latency_p99_us")
+	alpha := fs.Float64("alpha", 0.05, "significance level")
+
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: bench-multiget compare [flags] <base set> <set> [<set>...]")
+		fmt.Fprintln(fs.Output(), "A set is a json lines result file or a label in the history store")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errors.New("compare requires at least two result sets")
+	}
+
+	var sets []resultSet
+	var keys []string
+	seen := map[string]struct{}{}
+
+	for _, name := range fs.Args() {
+		path, err := resolveResultSet(historyDir, name)
+		if err != nil {
+			return err
+		}
+		records, err := loadResultSet(path)
+		if err != nil {
+			return err
+		}
+
+		s, setKeys, err := newResultSet(name, records, *metric)
+		if err != nil {
+			return err
+		}
+		sets = append(sets, s)
+
+		for _, key := range setKeys {
+			if _, existed := seen[key]; !existed {
+				seen[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	fmt.Println("METRIC:", *metric)
+	return compareResultSets(os.Stdout, sets, keys, *alpha)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func newCompareTestRecords(threads int, values ...float64) []resultRecord {
+	return mapSlice(values, func(v float64) resultRecord {
+		return resultRecord{
+			Backend:       backendCache,
+			Threads:       threads,
+			Batch:         40,
+			Conns:         4,
+			Dist:          distSequential,
+			Loops:         10_000,
+			GOGC:          "off",
+			GetsPerSecond: v,
+		}
+	})
+}
+
+func TestCompareResultSets(t *testing.T) {
+	oldRecords := append(
+		newCompareTestRecords(8, 100, 101, 99, 100, 100),
+		newCompareTestRecords(10, 200, 210, 190)...,
+	)
+	newRecords := append(
+		newCompareTestRecords(8, 110, 111, 109, 110, 110),
+		newCompareTestRecords(10, 205, 195, 200)...,
+	)
+
+	oldSet, keys, err := newResultSet("old", oldRecords, "gets_per_second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSet, _, err := newResultSet("new", newRecords, "gets_per_second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 scenarios, got %d", len(keys))
+	}
+
+	var buf bytes.Buffer
+	err = compareResultSets(&buf, []resultSet{oldSet, newSet}, keys, 0.05)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+	if !strings.Contains(lines[1], "threads=8") || !strings.Contains(lines[1], "+10.00%") {
+		t.Errorf("expected significant improvement:\n%s", lines[1])
+	}
+	if !strings.Contains(lines[2], "threads=10") || !strings.Contains(lines[2], "~ (p=") {
+		t.Errorf("expected insignificant delta:\n%s", lines[2])
+	}
+}
+
+func TestCompareSamples_ZeroBaseline(t *testing.T) {
+	c := compareSamples([]float64{0, 0, 0}, []float64{2, 3, 1}, 0.05)
+	if s := c.String(); s != "-" {
+		t.Errorf("expected no delta, got %s", s)
+	}
+}
+
+func TestNewResultSet_UnknownMetric(t *testing.T) {
+	_, _, err := newResultSet("old", newCompareTestRecords(8, 100), "gets")
+	if err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestHistoryConfig_Save(t *testing.T) {
+	history := historyConfig{
+		Dir:   t.TempDir(),
+		Label: "memproxy v1.1.0",
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := history.save(newOutputTestResult(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, err := resolveResultSet(history.Dir, "memproxy v1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := loadResultSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if records[0].scenarioKey() != records[1].scenarioKey() {
+		t.Errorf("expected same scenario: %s, %s", records[0].scenarioKey(), records[1].scenarioKey())
+	}
+}
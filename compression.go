@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compressor compresses the encoded cached values, the id is written in the header of every cached value
+type Compressor interface {
+	ID() byte
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+const (
+	compressionNone   = "none"
+	compressionSnappy = "snappy"
+	compressionZstd   = "zstd"
+	compressionLZ4    = "lz4"
+)
+
+var compressionNames = []string{compressionNone, compressionSnappy, compressionZstd, compressionLZ4}
+
+const (
+	compressionIDNone byte = iota
+	compressionIDSnappy
+	compressionIDZstd
+	compressionIDLZ4
+)
+
+func validateCompressionName(name string) error {
+	for _, n := range compressionNames {
+		if n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown compression '%s', must be one of: %s", name, strings.Join(compressionNames, ", "))
+}
+
+func newCompressor(name string) (Compressor, error) {
+	switch name {
+	case compressionNone:
+		return noCompressor{}, nil
+	case compressionSnappy:
+		return snappyCompressor{}, nil
+	case compressionZstd:
+		return zstdCompressor{}, nil
+	case compressionLZ4:
+		return lz4Compressor{}, nil
+	default:
+		return nil, validateCompressionName(name)
+	}
+}
+
+func compressorByID(id byte) (Compressor, error) {
+	switch id {
+	case compressionIDNone:
+		return noCompressor{}, nil
+	case compressionIDSnappy:
+		return snappyCompressor{}, nil
+	case compressionIDZstd:
+		return zstdCompressor{}, nil
+	case compressionIDLZ4:
+		return lz4Compressor{}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression id %d", id)
+	}
+}
+
+type noCompressor struct {
+}
+
+func (noCompressor) ID() byte     { return compressionIDNone }
+func (noCompressor) Name() string { return compressionNone }
+
+func (noCompressor) Compress(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+func (noCompressor) Decompress(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+type snappyCompressor struct {
+}
+
+func (snappyCompressor) ID() byte     { return compressionIDSnappy }
+func (snappyCompressor) Name() string { return compressionSnappy }
+
+func (snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCompressor) Decompress(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+// the zstd encoder and decoder are safe for concurrent use of EncodeAll and DecodeAll
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+type zstdCompressor struct {
+}
+
+func (zstdCompressor) ID() byte     { return compressionIDZstd }
+func (zstdCompressor) Name() string { return compressionZstd }
+
+func (zstdCompressor) Compress(src []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(src, nil), nil
+}
+
+func (zstdCompressor) Decompress(src []byte) ([]byte, error) {
+	return zstdDecoder.DecodeAll(src, nil)
+}
+
+// lz4Compressor uses the block format prefixed by the uncompressed size as an uvarint
+type lz4Compressor struct {
+}
+
+func (lz4Compressor) ID() byte     { return compressionIDLZ4 }
+func (lz4Compressor) Name() string { return compressionLZ4 }
+
+func (lz4Compressor) Compress(src []byte) ([]byte, error) {
+	dst := make([]byte, binary.MaxVarintLen64+lz4.CompressBlockBound(len(src)))
+	n := binary.PutUvarint(dst, uint64(len(src)))
+
+	var c lz4.Compressor
+	size, err := c.CompressBlock(src, dst[n:])
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 && len(src) > 0 {
+		return nil, errors.New("lz4: incompressible data")
+	}
+	return dst[:n+size], nil
+}
+
+func (lz4Compressor) Decompress(src []byte) ([]byte, error) {
+	rawSize, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errors.New("lz4: invalid size header")
+	}
+
+	dst := make([]byte, rawSize)
+	size, err := lz4.UncompressBlock(src[n:], dst)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(size) != rawSize {
+		return nil, errors.New("lz4: size mismatch")
+	}
+	return dst, nil
+}
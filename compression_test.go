@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"bench-multiget/pb"
+)
+
+func TestCompressors_RoundTrip(t *testing.T) {
+	data, err := newProduct(7).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range compressionNames {
+		c, err := newCompressor(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		compressed, err := c.Compress(data)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if name != compressionNone && len(compressed) >= len(data) {
+			t.Errorf("%s: expected compressed size smaller than %d, got %d", name, len(data), len(compressed))
+		}
+
+		decompressed, err := c.Decompress(compressed)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Errorf("%s: decompressed data not equal", name)
+		}
+	}
+}
+
+func TestCacheValue_WithCompression(t *testing.T) {
+	product := newProduct(3)
+	format := ValueFormat[*pb.Product]{
+		Codec:       jsonCodec[*pb.Product]{},
+		Compression: zstdCompressor{},
+	}
+
+	data, err := ProductCacheValue{Found: true, Data: product, format: format}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != codecIDJSON || data[1] != compressionIDZstd {
+		t.Errorf("unexpected header: %v", data[:2])
+	}
+
+	var stats DecodeStats
+	v, err := decodeCacheValue(newProductProto, data, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v.Data, product) {
+		t.Errorf("decoded product not equal, got %v", v.Data)
+	}
+	if stats.Count != 1 || stats.Bytes != uint64(len(data)) || stats.RawBytes <= stats.Bytes {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if format.Name() != "json+zstd" || defaultValueFormat[*pb.Product]().Name() != "" {
+		t.Errorf("unexpected format name: %s", format.Name())
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"bench-multiget/pb"
+)
+
+const (
+	esMethodSearch       = "search"
+	esMethodMGet         = "mget"
+	esMethodMGetRealtime = "mget-realtime"
+)
+
+var esMethodNames = []string{esMethodSearch, esMethodMGet, esMethodMGetRealtime}
+
+func validateESMethod(name string) error {
+	for _, n := range esMethodNames {
+		if n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown es method '%s', must be one of: %s", name, strings.Join(esMethodNames, ", "))
+}
+
+const (
+	esDecoderJSON     = "json"
+	esDecoderJSONIter = "jsoniter"
+
+	// esDecoderStream decodes the hits while reading the body, without holding the whole response
+	esDecoderStream = "stream"
+)
+
+var esDecoderNames = []string{esDecoderJSON, esDecoderJSONIter, esDecoderStream}
+
+func validateESDecoder(name string) error {
+	for _, n := range esDecoderNames {
+		if n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown es decoder '%s', must be one of: %s", name, strings.Join(esDecoderNames, ", "))
+}
+
+// searchHit is a search hit or a _mget doc, only the docs of _mget have the found field
+type searchHit struct {
+	ID     string      `json:"_id"`
+	Found  *bool       `json:"found"`
+	Source *pb.Product `json:"_source"`
+}
+
+// product returns nil for the not found docs. Without a _source, or when the projection
+// leaves out the sku, the sku is taken from the _id
+func (h searchHit) product() *pb.Product {
+	if h.Found != nil && !*h.Found {
+		return nil
+	}
+	p := h.Source
+	if p == nil {
+		p = &pb.Product{}
+	}
+	if p.Sku == "" {
+		p.Sku = h.ID
+	}
+	return p
+}
+
+type searchResponse struct {
+	Hits struct {
+		Hits []searchHit `json:"hits"`
+	} `json:"hits"`
+}
+
+func sourcesOf(hits []searchHit) []*pb.Product {
+	result := make([]*pb.Product, 0, len(hits))
+	for _, h := range hits {
+		if p := h.product(); p != nil {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// parseResponse decodes the _source of the hits of a search response
+func parseResponse(body io.Reader, decoder string) ([]*pb.Product, error) {
+	var products []*pb.Product
+	var err error
+
+	switch decoder {
+	case esDecoderJSON:
+		var r searchResponse
+		err = json.NewDecoder(body).Decode(&r)
+		products = sourcesOf(r.Hits.Hits)
+
+	case esDecoderStream:
+		products, err = streamSearchHits(body)
+
+	default:
+		var r searchResponse
+		err = jsoniter.NewDecoder(body).Decode(&r)
+		products = sourcesOf(r.Hits.Hits)
+	}
+
+	if err != nil {
+		return nil, withErrorKind(errKindDecode, err)
+	}
+	return products, nil
+}
+
+// mgetResponse is the response of _mget, the not found docs have no _source
+type mgetResponse struct {
+	Docs []searchHit `json:"docs"`
+}
+
+// parseMGetResponse decodes the _source of the found docs of a _mget response
+func parseMGetResponse(body io.Reader, decoder string) ([]*pb.Product, error) {
+	var products []*pb.Product
+	var err error
+
+	switch decoder {
+	case esDecoderJSON:
+		var r mgetResponse
+		err = json.NewDecoder(body).Decode(&r)
+		products = sourcesOf(r.Docs)
+
+	case esDecoderStream:
+		products, err = streamMGetDocs(body)
+
+	default:
+		var r mgetResponse
+		err = jsoniter.NewDecoder(body).Decode(&r)
+		products = sourcesOf(r.Docs)
+	}
+
+	if err != nil {
+		return nil, withErrorKind(errKindDecode, err)
+	}
+	return products, nil
+}
+
+// readSources reads an array of hits or docs, appending their products
+func readSources(iter *jsoniter.Iterator, products *[]*pb.Product) bool {
+	return iter.ReadArrayCB(func(iter *jsoniter.Iterator) bool {
+		var h searchHit
+		ok := iter.ReadObjectCB(func(iter *jsoniter.Iterator, field string) bool {
+			switch field {
+			case "_id":
+				h.ID = iter.ReadString()
+			case "found":
+				found := iter.ReadBool()
+				h.Found = &found
+			case "_source":
+				h.Source = &pb.Product{}
+				iter.ReadVal(h.Source)
+			default:
+				iter.Skip()
+			}
+			return true
+		})
+		if p := h.product(); ok && p != nil {
+			*products = append(*products, p)
+		}
+		return ok
+	})
+}
+
+func streamMGetDocs(body io.Reader) ([]*pb.Product, error) {
+	iter := jsoniter.Parse(jsoniter.ConfigDefault, body, 4096)
+
+	var products []*pb.Product
+	iter.ReadObjectCB(func(iter *jsoniter.Iterator, field string) bool {
+		if field != "docs" {
+			iter.Skip()
+			return true
+		}
+		return readSources(iter, &products)
+	})
+
+	if iter.Error != nil && iter.Error != io.EOF {
+		return nil, iter.Error
+	}
+	return products, nil
+}
+
+// streamSearchHits walks the response with a jsoniter iterator, only the hits._source values are decoded
+func streamSearchHits(body io.Reader) ([]*pb.Product, error) {
+	iter := jsoniter.Parse(jsoniter.ConfigDefault, body, 4096)
+
+	var products []*pb.Product
+	iter.ReadObjectCB(func(iter *jsoniter.Iterator, field string) bool {
+		if field != "hits" {
+			iter.Skip()
+			return true
+		}
+		return iter.ReadObjectCB(func(iter *jsoniter.Iterator, field string) bool {
+			if field != "hits" {
+				iter.Skip()
+				return true
+			}
+			return readSources(iter, &products)
+		})
+	})
+
+	if iter.Error != nil && iter.Error != io.EOF {
+		return nil, iter.Error
+	}
+	return products, nil
+}
+
+// orderBySkus returns the products in the same order as skus, with nil for the skus without a hit.
+// Hits of skus not requested, or duplicated hits, mean the index does not match the query
+func orderBySkus(skus []string, products []*pb.Product) ([]*pb.Product, error) {
+	found := make(map[string]*pb.Product, len(skus))
+	for _, sku := range skus {
+		found[sku] = nil
+	}
+
+	for _, p := range products {
+		prev, requested := found[p.Sku]
+		if !requested {
+			return nil, withErrorKind(errKindElastic, fmt.Errorf("unexpected sku '%s' in response", p.Sku))
+		}
+		if prev != nil {
+			return nil, withErrorKind(errKindElastic, fmt.Errorf("duplicated sku '%s' in response", p.Sku))
+		}
+		found[p.Sku] = p
+	}
+
+	return mapSlice(skus, func(sku string) *pb.Product {
+		return found[sku]
+	}), nil
+}
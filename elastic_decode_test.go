@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"bench-multiget/pb"
+)
+
+func newSearchResponseBody(t *testing.T, products ...*pb.Product) string {
+	t.Helper()
+
+	hits := make([]string, 0, len(products))
+	for _, p := range products {
+		source, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits = append(hits, fmt.Sprintf(
+			`{"_index":"multiget_products","_id":"%s","_score":0.0,"_source":%s,"sort":[1,"a"]}`, p.Sku, source,
+		))
+	}
+	return fmt.Sprintf(
+		`{"took":3,"timed_out":false,"_shards":{"total":1,"successful":1,"skipped":0,"failed":0},`+
+			`"hits":{"total":{"value":%d,"relation":"eq"},"max_score":0.0,"hits":[%s]}}`,
+		len(products), strings.Join(hits, ","),
+	)
+}
+
+func TestParseResponse_Decoders(t *testing.T) {
+	expected := []*pb.Product{newProduct(0), newProduct(1)}
+	body := newSearchResponseBody(t, expected...)
+
+	for _, decoder := range esDecoderNames {
+		products, err := parseResponse(strings.NewReader(body), decoder)
+		if err != nil {
+			t.Fatalf("decoder %s: %v", decoder, err)
+		}
+		if !reflect.DeepEqual(products, expected) {
+			t.Errorf("decoder %s: unexpected products: %v", decoder, products)
+		}
+
+		if _, err := parseResponse(strings.NewReader(body[:len(body)/2]), decoder); errorKind(err) != errKindDecode {
+			t.Errorf("decoder %s: expected decode error for truncated body, got %v", decoder, err)
+		}
+	}
+}
+
+func TestOrderBySkus(t *testing.T) {
+	p1 := &pb.Product{Sku: "SKU01"}
+	p3 := &pb.Product{Sku: "SKU03"}
+
+	products, err := orderBySkus([]string{"SKU01", "SKU02", "SKU03"}, []*pb.Product{p3, p1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(products, []*pb.Product{p1, nil, p3}) {
+		t.Errorf("unexpected products: %v", products)
+	}
+
+	if _, err := orderBySkus([]string{"SKU01"}, []*pb.Product{p3}); errorKind(err) != errKindElastic {
+		t.Errorf("expected error for not requested sku, got %v", err)
+	}
+	if _, err := orderBySkus([]string{"SKU01"}, []*pb.Product{p1, p1}); errorKind(err) != errKindElastic {
+		t.Errorf("expected error for duplicated sku, got %v", err)
+	}
+}
+
+func TestParseMGetResponse_Decoders(t *testing.T) {
+	p := newProduct(0)
+	source, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(
+		`{"docs":[{"_index":"multiget_products","_id":"%s","_version":1,"_seq_no":0,"_primary_term":1,"found":true,"_source":%s},`+
+			`{"_index":"multiget_products","_id":"SKU-NOT-FOUND","found":false}]}`,
+		p.Sku, source,
+	)
+
+	for _, decoder := range esDecoderNames {
+		products, err := parseMGetResponse(strings.NewReader(body), decoder)
+		if err != nil {
+			t.Fatalf("decoder %s: %v", decoder, err)
+		}
+		if !reflect.DeepEqual(products, []*pb.Product{p}) {
+			t.Errorf("decoder %s: unexpected products: %v", decoder, products)
+		}
+
+		if _, err := parseMGetResponse(strings.NewReader(body[:len(body)/2]), decoder); errorKind(err) != errKindDecode {
+			t.Errorf("decoder %s: expected decode error for truncated body, got %v", decoder, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// indexVersionPrefix is the prefix of the versions of the index, the alias indexName points to one of them
+const indexVersionPrefix = indexName + "_v"
+
+// indexVersionName returns a new version, the versions of the same length sort by creation time
+func indexVersionName(now time.Time) string {
+	return fmt.Sprintf("%s%d", indexVersionPrefix, now.UnixMilli())
+}
+
+func (r *ElasticRepo) refreshIndex(index string) error {
+	refreshFn := r.client.Indices.Refresh
+	resp, err := refreshFn(refreshFn.WithIndex(index))
+	if err != nil {
+		return withErrorKind(errKindElastic, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return elasticStatusError(resp)
+	}
+	return nil
+}
+
+// getIndices returns the concrete indices matching the names, aliases resolve to the indices they point to
+func (r *ElasticRepo) getIndices(names ...string) ([]string, error) {
+	getFn := r.client.Indices.Get
+	resp, err := getFn(names, getFn.WithFilterPath("*.settings.index.provided_name"))
+	if err != nil {
+		return nil, withErrorKind(errKindElastic, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, elasticStatusError(resp)
+	}
+
+	var indices map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&indices); err != nil {
+		return nil, withErrorKind(errKindDecode, err)
+	}
+
+	result := make([]string, 0, len(indices))
+	for index := range indices {
+		result = append(result, index)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+type aliasAction struct {
+	Add         *aliasTarget `json:"add,omitempty"`
+	Remove      *aliasTarget `json:"remove,omitempty"`
+	RemoveIndex *aliasTarget `json:"remove_index,omitempty"`
+}
+
+type aliasTarget struct {
+	Index string `json:"index"`
+	Alias string `json:"alias,omitempty"`
+}
+
+// switchAliasActions points the alias to the index, removing it from the current indices.
+// A current index with the name of the alias is an index created before the versions, it is deleted
+func switchAliasActions(alias string, index string, current []string) []aliasAction {
+	actions := []aliasAction{{Add: &aliasTarget{Index: index, Alias: alias}}}
+	for _, c := range current {
+		if c == alias {
+			actions = append(actions, aliasAction{RemoveIndex: &aliasTarget{Index: c}})
+			continue
+		}
+		actions = append(actions, aliasAction{Remove: &aliasTarget{Index: c, Alias: alias}})
+	}
+	return actions
+}
+
+// switchAlias applies the actions in a single request, so the readers never see a missing index
+func (r *ElasticRepo) switchAlias(index string) error {
+	current, err := r.getIndices(indexName)
+	if err != nil {
+		return err
+	}
+
+	type aliasesBody struct {
+		Actions []aliasAction `json:"actions"`
+	}
+	var buf bytes.Buffer
+	err = json.NewEncoder(&buf).Encode(aliasesBody{
+		Actions: switchAliasActions(indexName, index, current),
+	})
+	if err != nil {
+		return err
+	}
+
+	updateFn := r.client.Indices.UpdateAliases
+	resp, err := updateFn(&buf)
+	if err != nil {
+		return withErrorKind(errKindElastic, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return elasticStatusError(resp)
+	}
+	return nil
+}
+
+// oldVersions returns the versions older than the live index, except the keep latest ones
+func oldVersions(versions []string, live string, keep int) []string {
+	var older []string
+	for _, v := range versions {
+		if strings.HasPrefix(v, indexVersionPrefix) && len(v) == len(live) && v < live {
+			older = append(older, v)
+		}
+	}
+	sort.Strings(older)
+
+	if len(older) <= keep {
+		return nil
+	}
+	return older[:len(older)-keep]
+}
+
+func (r *ElasticRepo) deleteOldVersions(live string, keep int) error {
+	versions, err := r.getIndices(indexVersionPrefix + "*")
+	if err != nil {
+		return err
+	}
+	for _, index := range oldVersions(versions, live, keep) {
+		if err := r.deleteIndex(index); err != nil {
+			return err
+		}
+		fmt.Println("DELETED:", index)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSwitchAliasActions(t *testing.T) {
+	actions := switchAliasActions(indexName, "multiget_products_v2", []string{"multiget_products_v1", indexName})
+
+	data, err := json.Marshal(actions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"add":{"index":"multiget_products_v2","alias":"multiget_products"}},` +
+		`{"remove":{"index":"multiget_products_v1","alias":"multiget_products"}},` +
+		`{"remove_index":{"index":"multiget_products"}}]`
+	if string(data) != expected {
+		t.Errorf("unexpected actions: %s", data)
+	}
+}
+
+func TestOldVersions(t *testing.T) {
+	start := time.UnixMilli(1700000000000)
+	v1 := indexVersionName(start)
+	v2 := indexVersionName(start.Add(time.Second))
+	v3 := indexVersionName(start.Add(2 * time.Second))
+	live := indexVersionName(start.Add(3 * time.Second))
+	// created by a concurrent sync after the live one
+	newer := indexVersionName(start.Add(4 * time.Second))
+
+	versions := []string{v3, live, "multiget_products_vtest", v1, newer, v2}
+	if result := oldVersions(versions, live, 1); !reflect.DeepEqual(result, []string{v1, v2}) {
+		t.Errorf("unexpected old versions: %v", result)
+	}
+	if result := oldVersions(versions, live, 0); !reflect.DeepEqual(result, []string{v1, v2, v3}) {
+		t.Errorf("unexpected old versions: %v", result)
+	}
+	if result := oldVersions(versions, live, 3); len(result) != 0 {
+		t.Errorf("unexpected old versions: %v", result)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+const (
+	// esProjectionSource returns the whole _source
+	esProjectionSource = "source"
+
+	esProjectionIncludes = "includes"
+	esProjectionExcludes = "excludes"
+
+	// esProjectionDocValue and esProjectionStored return the fields without the _source,
+	// the products only have their sku, taken from the _id
+	esProjectionDocValue = "docvalue"
+	esProjectionStored   = "stored"
+)
+
+var esProjectionKinds = []string{
+	esProjectionSource, esProjectionIncludes, esProjectionExcludes, esProjectionDocValue, esProjectionStored,
+}
+
+// esProjection is the part of the documents returned by elasticsearch,
+// written as "source" or "<kind>:<field>,<field>", e.g. "excludes:attributes"
+type esProjection struct {
+	Kind   string
+	Fields []string
+}
+
+func parseESProjection(spec string) (esProjection, error) {
+	kind, fields, hasFields := strings.Cut(spec, ":")
+
+	var p esProjection
+	for _, k := range esProjectionKinds {
+		if k == kind {
+			p.Kind = kind
+		}
+	}
+	if p.Kind == "" {
+		return esProjection{}, fmt.Errorf(
+			"unknown es projection '%s', must be one of: %s", spec, strings.Join(esProjectionKinds, ", "),
+		)
+	}
+
+	if p.Kind == esProjectionSource {
+		if hasFields {
+			return esProjection{}, errors.New("es projection 'source' has no fields")
+		}
+		return p, nil
+	}
+
+	for _, f := range strings.Split(fields, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			p.Fields = append(p.Fields, f)
+		}
+	}
+	if len(p.Fields) == 0 {
+		return esProjection{}, fmt.Errorf("es projection '%s' requires fields, e.g. '%s:sku'", spec, p.Kind)
+	}
+	return p, nil
+}
+
+// validateESProjection also checks the projection is supported by the method, _mget has no docvalue fields
+func validateESProjection(spec string, method string) error {
+	p, err := parseESProjection(spec)
+	if err != nil {
+		return err
+	}
+	if p.Kind == esProjectionDocValue && method != esMethodSearch {
+		return fmt.Errorf("es projection '%s' requires method '%s'", esProjectionDocValue, esMethodSearch)
+	}
+	return nil
+}
+
+// searchBody returns the _source, docvalue_fields and stored_fields of a search request
+func (p esProjection) searchBody() (source any, docValueFields []string, storedFields []string) {
+	switch p.Kind {
+	case esProjectionIncludes:
+		return map[string][]string{"includes": p.Fields}, nil, nil
+	case esProjectionExcludes:
+		return map[string][]string{"excludes": p.Fields}, nil, nil
+	case esProjectionDocValue:
+		return false, p.Fields, nil
+	case esProjectionStored:
+		return false, nil, p.Fields
+	default:
+		return true, nil, nil
+	}
+}
+
+func (p esProjection) mgetOptions(mgetFn esapi.Mget) []func(*esapi.MgetRequest) {
+	switch p.Kind {
+	case esProjectionIncludes:
+		return []func(*esapi.MgetRequest){mgetFn.WithSourceIncludes(p.Fields...)}
+	case esProjectionExcludes:
+		return []func(*esapi.MgetRequest){mgetFn.WithSourceExcludes(p.Fields...)}
+	case esProjectionStored:
+		return []func(*esapi.MgetRequest){mgetFn.WithSource("false"), mgetFn.WithStoredFields(p.Fields...)}
+	default:
+		return nil
+	}
+}
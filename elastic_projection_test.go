@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"bench-multiget/pb"
+)
+
+func TestParseESProjection(t *testing.T) {
+	p, err := parseESProjection("excludes:attributes, brand.name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, esProjection{Kind: esProjectionExcludes, Fields: []string{"attributes", "brand.name"}}) {
+		t.Errorf("unexpected projection: %+v", p)
+	}
+
+	for _, spec := range []string{"", "all", "source:sku", "includes", "stored:"} {
+		if _, err := parseESProjection(spec); err == nil {
+			t.Errorf("expected error for '%s'", spec)
+		}
+	}
+
+	if err := validateESProjection("docvalue:sku", esMethodMGet); err == nil {
+		t.Error("expected error for docvalue fields with mget")
+	}
+	if err := validateESProjection("stored:sku", esMethodMGet); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseResponse_WithoutSource(t *testing.T) {
+	body := `{"took":1,"timed_out":false,"hits":{"total":{"value":1,"relation":"eq"},"hits":[` +
+		`{"_index":"multiget_products","_id":"SKU01","_score":0.0,"fields":{"sku":["SKU01"]}},` +
+		`{"_index":"multiget_products","_id":"SKU02","_score":0.0,"_source":{"display_name":"Product 2"}}]}}`
+
+	expected := []*pb.Product{{Sku: "SKU01"}, {Sku: "SKU02", DisplayName: "Product 2"}}
+	for _, decoder := range esDecoderNames {
+		products, err := parseResponse(strings.NewReader(body), decoder)
+		if err != nil {
+			t.Fatalf("decoder %s: %v", decoder, err)
+		}
+		if !reflect.DeepEqual(products, expected) {
+			t.Errorf("decoder %s: unexpected products: %v", decoder, products)
+		}
+	}
+}
@@ -8,58 +8,114 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/jmoiron/sqlx"
 	jsoniter "github.com/json-iterator/go"
 	"io"
 	"net/http"
-	"sync/atomic"
+	"time"
 )
 
 type ElasticRepo struct {
-	db     *sqlx.DB
-	client *elasticsearch.Client
+	db         *sqlx.DB
+	client     *elasticsearch.Client
+	options    elasticRepoOptions
+	projection esProjection
 }
 
-func NewElasticRepo(db *sqlx.DB, esAddr string) *ElasticRepo {
+type elasticRepoOptions struct {
+	method     string
+	decoder    string
+	projection string
+}
+
+// ElasticRepoOption configures the elasticsearch repo created by NewElasticRepo
+type ElasticRepoOption func(opts *elasticRepoOptions)
+
+// WithESMethod sets the API used to get the products, default is a terms search
+func WithESMethod(method string) ElasticRepoOption {
+	return func(opts *elasticRepoOptions) {
+		opts.method = method
+	}
+}
+
+// WithESProjection sets the part of the documents returned, default is the whole _source
+func WithESProjection(spec string) ElasticRepoOption {
+	return func(opts *elasticRepoOptions) {
+		opts.projection = spec
+	}
+}
+
+// WithESDecoder sets the decoder of the responses, default is jsoniter
+func WithESDecoder(decoder string) ElasticRepoOption {
+	return func(opts *elasticRepoOptions) {
+		opts.decoder = decoder
+	}
+}
+
+func NewElasticRepo(db *sqlx.DB, esAddr string, options ...ElasticRepoOption) (*ElasticRepo, error) {
 	client, err := elasticsearch.NewClient(elasticsearch.Config{
 		Addresses: []string{esAddr},
 	})
 	if err != nil {
-		panic(err)
+		return nil, withErrorKind(errKindElastic, err)
 	}
-	return &ElasticRepo{
+
+	r := &ElasticRepo{
 		db:     db,
 		client: client,
+		options: elasticRepoOptions{
+			method:     esMethodSearch,
+			decoder:    esDecoderJSONIter,
+			projection: esProjectionSource,
+		},
+	}
+	for _, opt := range options {
+		opt(&r.options)
 	}
+
+	if err := validateESProjection(r.options.projection, r.options.method); err != nil {
+		return nil, err
+	}
+	r.projection, _ = parseESProjection(r.options.projection)
+	return r, nil
 }
 
-func (r *ElasticRepo) getProductsAfter(ctx context.Context, sku string, limit int) []*pb.Product {
+func (r *ElasticRepo) getProductsAfter(ctx context.Context, sku string, limit int) ([]*pb.Product, error) {
 	query := `
 SELECT sku, content FROM products WHERE sku > ? ORDER BY sku LIMIT ?
 `
 	var result []ProductContent
 	err := r.db.SelectContext(ctx, &result, query, sku, limit)
 	if err != nil {
-		panic(err)
+		return nil, withErrorKind(errKindMySQL, err)
 	}
-
-	return mapSlice(result, func(p ProductContent) *pb.Product {
-		var product pb.Product
-		err := json.Unmarshal(p.Content, &product)
-		if err != nil {
-			panic(err)
-		}
-		return &product
-	})
+	return decodeProductContents(result)
 }
 
 func lastElem[T any](input []T) T {
 	return input[len(input)-1]
 }
 
+// indexName is the alias of the live version of the index, readers and updates go through it
 const indexName = "multiget_products"
 
-func (r *ElasticRepo) syncToElastic(products []*pb.Product) {
+// elasticStatusError reads the body of a non successful response into an error
+func elasticStatusError(resp *esapi.Response) error {
+	data, _ := io.ReadAll(resp.Body)
+	return withErrorKind(errKindElastic, fmt.Errorf("status %d: %s", resp.StatusCode, data))
+}
+
+func (r *ElasticRepo) syncToElastic(index string, products []*pb.Product) error {
+	return r.bulkToElastic(index, products, nil)
+}
+
+// bulkToElastic indexes the products and deletes the skus in a single bulk request,
+// it fails when any item is rejected, so the incremental sync does not store its watermark past it
+func (r *ElasticRepo) bulkToElastic(index string, products []*pb.Product, deletedSkus []string) error {
+	if len(products) == 0 && len(deletedSkus) == 0 {
+		return nil
+	}
 	bulkFn := r.client.Bulk
 
 	type indexObject struct {
@@ -70,6 +126,10 @@ func (r *ElasticRepo) syncToElastic(products []*pb.Product) {
 		Index indexObject `json:"index"`
 	}
 
+	type deleteAction struct {
+		Delete indexObject `json:"delete"`
+	}
+
 	var buf bytes.Buffer
 	enc := json.NewEncoder(&buf)
 	for _, p := range products {
@@ -79,46 +139,95 @@ func (r *ElasticRepo) syncToElastic(products []*pb.Product) {
 			},
 		})
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		err = enc.Encode(p)
 		if err != nil {
-			panic(err)
+			return err
+		}
+	}
+	for _, sku := range deletedSkus {
+		if err := enc.Encode(deleteAction{Delete: indexObject{ID: sku}}); err != nil {
+			return err
 		}
 	}
 
-	resp, err := bulkFn(&buf, bulkFn.WithIndex(indexName))
+	resp, err := bulkFn(&buf, bulkFn.WithIndex(index))
 	if err != nil {
-		panic(err)
+		return withErrorKind(errKindElastic, err)
 	}
 	defer func() { _ = resp.Body.Close() }()
 
 	if resp.StatusCode != http.StatusOK {
-		data, _ := io.ReadAll(resp.Body)
-		panic(string(data))
+		return elasticStatusError(resp)
+	}
+	return bulkResponseError(resp.Body)
+}
+
+type bulkItem struct {
+	ID     string          `json:"_id"`
+	Status int             `json:"status"`
+	Result string          `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// bulkResponseError returns an error naming the rejected documents, a bulk request succeeds
+// even when some of its items fail. Deletes of missing documents are not failures
+func bulkResponseError(body io.Reader) error {
+	var resp struct {
+		Errors bool                  `json:"errors"`
+		Items  []map[string]bulkItem `json:"items"`
 	}
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return withErrorKind(errKindDecode, err)
+	}
+	if !resp.Errors {
+		return nil
+	}
+
+	var failed []string
+	var firstError json.RawMessage
+	for _, item := range resp.Items {
+		for action, result := range item {
+			if action == "delete" && result.Result == "not_found" {
+				continue
+			}
+			if result.Status >= 300 || len(result.Error) > 0 {
+				failed = append(failed, result.ID)
+				if firstError == nil {
+					firstError = result.Error
+				}
+			}
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return withErrorKind(errKindElastic, fmt.Errorf(
+		"bulk failed for %d documents %v: %s", len(failed), failed, firstError,
+	))
 }
 
-func (r *ElasticRepo) deleteIndex() {
+func (r *ElasticRepo) deleteIndex(index string) error {
 	deleteFn := r.client.Indices.Delete
-	resp, err := deleteFn([]string{indexName})
+	resp, err := deleteFn([]string{index})
 	if err != nil {
-		panic(err)
+		return withErrorKind(errKindElastic, err)
 	}
 
 	defer func() { _ = resp.Body.Close() }()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
-		data, _ := io.ReadAll(resp.Body)
-		panic(string(data))
+		return elasticStatusError(resp)
 	}
+	return nil
 }
 
 //go:embed mapping.json
 var indexMapping string
 
-func (r *ElasticRepo) createIndex() {
+func (r *ElasticRepo) createIndex(index string) error {
 	createFn := r.client.Indices.Create
 
 	type createBody struct {
@@ -132,68 +241,100 @@ func (r *ElasticRepo) createIndex() {
 		Mappings: []byte(indexMapping),
 	})
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	resp, err := createFn(indexName, createFn.WithBody(&buf))
+	resp, err := createFn(index, createFn.WithBody(&buf))
 	if err != nil {
-		panic(err)
+		return withErrorKind(errKindElastic, err)
 	}
 	defer func() { _ = resp.Body.Close() }()
 
 	if resp.StatusCode != http.StatusOK {
-		data, _ := io.ReadAll(resp.Body)
-		panic(string(data))
+		return elasticStatusError(resp)
 	}
+	return nil
 }
 
-func (r *ElasticRepo) SyncProducts() {
-	r.deleteIndex()
-	r.createIndex()
+// SyncProducts loads the products into a new version of the index, then switches the alias to it.
+// Readers keep using the previous version until the switch, which is atomic.
+// Only the keepVersions latest previous versions are kept after the switch.
+// The incremental sync of the new version starts from the beginning of the load, minus settle
+func (r *ElasticRepo) SyncProducts(keepVersions int, settle time.Duration) error {
+	start, err := dbNow(context.Background(), r.db)
+	if err != nil {
+		return err
+	}
+
+	index := indexVersionName(time.Now())
+	if err := r.createIndex(index); err != nil {
+		return err
+	}
+
+	if err := r.loadIndex(index); err != nil {
+		// the aborted version is not used by the readers
+		_ = r.deleteIndex(index)
+		return err
+	}
+	if err := r.putWatermark(context.Background(), index, newSyncWatermark(start, settle)); err != nil {
+		_ = r.deleteIndex(index)
+		return err
+	}
+	if err := r.refreshIndex(index); err != nil {
+		_ = r.deleteIndex(index)
+		return err
+	}
+
+	if err := r.switchAlias(index); err != nil {
+		_ = r.deleteIndex(index)
+		return err
+	}
+	fmt.Println("ALIAS:", indexName, "->", index)
+
+	return r.deleteOldVersions(index, keepVersions)
+}
 
+func (r *ElasticRepo) loadIndex(index string) error {
 	lastSku := ""
 	for {
-		products := r.getProductsAfter(context.Background(), lastSku, 64)
+		products, err := r.getProductsAfter(context.Background(), lastSku, syncBatchSize)
+		if err != nil {
+			return err
+		}
 		if len(products) == 0 {
-			return
+			return nil
 		}
 		lastSku = lastElem(products).Sku
 
-		r.syncToElastic(products)
+		if err := r.syncToElastic(index, products); err != nil {
+			return err
+		}
 		fmt.Println("SYNC:", len(products))
 	}
 }
 
-func parseResponse(body io.Reader) []*pb.Product {
-	type responseHit struct {
-		Source json.RawMessage `json:"_source"`
-	}
-
-	type responseHits struct {
-		Hits []responseHit `json:"hits"`
-	}
-	type response struct {
-		Hits responseHits `json:"hits"`
+// UpdateProducts updates the products in the database then re-indexes them,
+// the new contents are visible to searches after the next index refresh.
+// Updates during a full sync go to the previous version, the incremental sync replays them on the new one
+func (r *ElasticRepo) UpdateProducts(ctx context.Context, products []*pb.Product) error {
+	if err := updateProductContents(ctx, r.db, products); err != nil {
+		return err
 	}
+	return r.syncToElastic(indexName, products)
+}
 
-	var r response
-	err := jsoniter.NewDecoder(body).Decode(&r)
-	if err != nil {
-		panic(err)
-	}
+type countingReader struct {
+	reader io.Reader
+	count  uint64
+}
 
-	return mapSlice(r.Hits.Hits, func(e responseHit) *pb.Product {
-		//var p pb.Product
-		//err := jsoniter.Unmarshal(e.Source, &p)
-		//if err != nil {
-		//	panic(err)
-		//}
-		//return &p
-		return nil
-	})
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += uint64(n)
+	return n, err
 }
 
-func (r *ElasticRepo) GetProducts(skus []string, totalBytes *atomic.Uint64) []*pb.Product {
+func (r *ElasticRepo) search(ctx context.Context, skus []string) (*esapi.Response, error) {
 	type filterQuery struct {
 		Terms map[string]any `json:"terms"`
 	}
@@ -206,13 +347,16 @@ func (r *ElasticRepo) GetProducts(skus []string, totalBytes *atomic.Uint64) []*p
 		Bool boolQuery `json:"bool"`
 	}
 	type searchQuery struct {
-		Query        searchObject `json:"query"`
-		Source       any          `json:"_source,omitempty"`
-		Fields       []string     `json:"docvalue_fields,omitempty"`
-		StoredFields string       `json:"stored_fields,omitempty"`
+		Query          searchObject `json:"query"`
+		Size           int          `json:"size"`
+		Source         any          `json:"_source"`
+		DocValueFields []string     `json:"docvalue_fields,omitempty"`
+		StoredFields   []string     `json:"stored_fields,omitempty"`
 	}
 	var buf bytes.Buffer
 
+	source, docValueFields, storedFields := r.projection.searchBody()
+
 	enc := jsoniter.NewEncoder(&buf)
 	err := enc.Encode(searchQuery{
 		Query: searchObject{
@@ -224,27 +368,118 @@ func (r *ElasticRepo) GetProducts(skus []string, totalBytes *atomic.Uint64) []*p
 				},
 			},
 		},
-		// Source: []string{"sku", "attributes"},
-		Source:       false,
-		Fields:       []string{"sku"},
-		StoredFields: "_none_",
+		// the default size is 10 hits
+		Size: len(skus),
+
+		Source:         source,
+		DocValueFields: docValueFields,
+		StoredFields:   storedFields,
 	})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	// fmt.Println("QUERY:", buf.String())
 
 	searchFn := r.client.Search
-	resp, err := searchFn(searchFn.WithBody(&buf), searchFn.WithIndex(indexName))
+	return searchFn(
+		searchFn.WithContext(ctx),
+		searchFn.WithBody(&buf),
+		searchFn.WithIndex(indexName),
+	)
+}
+
+// multiGet gets the documents by _id, which is the sku.
+// A realtime get also returns the documents indexed after the last refresh
+func (r *ElasticRepo) multiGet(ctx context.Context, skus []string, realtime bool) (*esapi.Response, error) {
+	type mgetQuery struct {
+		IDs []string `json:"ids"`
+	}
+
+	var buf bytes.Buffer
+	err := jsoniter.NewEncoder(&buf).Encode(mgetQuery{
+		// duplicated ids would return duplicated docs
+		IDs: distinctStrings(skus),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mgetFn := r.client.Mget
+	return mgetFn(&buf, append([]func(*esapi.MgetRequest){
+		mgetFn.WithContext(ctx),
+		mgetFn.WithIndex(indexName),
+		mgetFn.WithRealtime(realtime),
+	}, r.projection.mgetOptions(mgetFn)...)...)
+}
+
+func distinctStrings(list []string) []string {
+	seen := make(map[string]struct{}, len(list))
+	result := make([]string, 0, len(list))
+	for _, s := range list {
+		if _, existed := seen[s]; !existed {
+			seen[s] = struct{}{}
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// GetProducts returns the products in the same order as skus, with nil for the not found skus.
+// DecodeTime includes the read of the response body, which the stream decoder interleaves with the decoding
+func (r *ElasticRepo) GetProducts(ctx context.Context, skus []string) ([]*pb.Product, BatchStats, error) {
+	var resp *esapi.Response
+	var err error
+
+	method := r.options.method
+	switch method {
+	case esMethodMGet:
+		resp, err = r.multiGet(ctx, skus, false)
+	case esMethodMGetRealtime:
+		resp, err = r.multiGet(ctx, skus, true)
+	default:
+		resp, err = r.search(ctx, skus)
+	}
 	if err != nil {
-		panic(err)
+		return nil, BatchStats{}, withErrorKind(errKindElastic, err)
 	}
 	defer func() { _ = resp.Body.Close() }()
 
 	if resp.StatusCode != http.StatusOK {
-		data, _ := io.ReadAll(resp.Body)
-		panic(string(data))
+		return nil, BatchStats{}, elasticStatusError(resp)
+	}
+
+	start := time.Now()
+	body := &countingReader{reader: resp.Body}
+	var hits []*pb.Product
+	if method == esMethodSearch {
+		hits, err = parseResponse(body, r.options.decoder)
+	} else {
+		hits, err = parseMGetResponse(body, r.options.decoder)
+	}
+	if err != nil {
+		return nil, BatchStats{}, err
 	}
+	decodeTime := time.Since(start)
 
-	return parseResponse(resp.Body)
+	products, err := orderBySkus(skus, hits)
+	if err != nil {
+		return nil, BatchStats{}, err
+	}
+
+	var notFound uint64
+	for _, p := range products {
+		if p == nil {
+			notFound++
+		}
+	}
+	return products, BatchStats{
+		HitCount:      uint64(len(skus)) - notFound,
+		MissCount:     notFound,
+		NotFoundCount: notFound,
+		TotalBytes:    body.count,
+
+		DecodeCount:    uint64(len(hits)),
+		DecodeBytes:    body.count,
+		DecodeRawBytes: body.count,
+		DecodeTime:     decodeTime,
+	}, nil
 }
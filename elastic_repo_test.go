@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBulkResponseError(t *testing.T) {
+	ok := `{"took":3,"errors":false,"items":[{"index":{"_id":"SKU01","status":200,"result":"updated"}}]}`
+	if err := bulkResponseError(strings.NewReader(ok)); err != nil {
+		t.Error(err)
+	}
+
+	notFound := `{"took":3,"errors":true,"items":[
+{"index":{"_id":"SKU01","status":200,"result":"updated"}},
+{"delete":{"_id":"SKU02","status":404,"result":"not_found"}}
+]}`
+	if err := bulkResponseError(strings.NewReader(notFound)); err != nil {
+		t.Errorf("deletes of missing documents must succeed: %v", err)
+	}
+
+	failed := `{"took":3,"errors":true,"items":[
+{"index":{"_id":"SKU01","status":200,"result":"updated"}},
+{"index":{"_id":"SKU02","status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}},
+{"delete":{"_id":"SKU03","status":404,"result":"not_found"}}
+]}`
+	err := bulkResponseError(strings.NewReader(failed))
+	if err == nil {
+		t.Fatal("expected an error for the rejected item")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "SKU02") || strings.Contains(msg, "SKU01") ||
+		strings.Contains(msg, "SKU03") || !strings.Contains(msg, "mapper_parsing_exception") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
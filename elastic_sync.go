@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// createProductDeletesSQL creates the tombstones of the deleted products, read by the incremental sync
+// and pruned once synced to every index version, see pruneDeletes
+var createProductDeletesSQL = `
+CREATE TABLE IF NOT EXISTS product_deletes (
+    sku VARCHAR(100) NOT NULL PRIMARY KEY,
+    deleted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_product_deletes_deleted_at (deleted_at, sku)
+)
+`
+
+const productsUpdatedAtIndex = "idx_products_updated_at"
+
+// migrateSyncTables also adds the (updated_at, sku) index to the products tables created before it
+func migrateSyncTables(db *sqlx.DB) {
+	db.MustExec(createProductDeletesSQL)
+
+	var count int
+	err := db.Get(&count, `
+SELECT COUNT(*) FROM information_schema.statistics
+WHERE table_schema = DATABASE() AND table_name = 'products' AND index_name = ?
+`, productsUpdatedAtIndex)
+	if err != nil {
+		panic(err)
+	}
+	if count == 0 {
+		db.MustExec(fmt.Sprintf(`CREATE INDEX %s ON products (updated_at, sku)`, productsUpdatedAtIndex))
+	}
+}
+
+const syncBatchSize = 64
+
+// syncWatermark is the position of the incremental sync in the products and in the deletes,
+// stored in the _meta of the index version it applies to. A new version starts from its full sync
+type syncWatermark struct {
+	UpdatedAt  time.Time `json:"updated_at"`
+	Sku        string    `json:"sku"`
+	DeletedAt  time.Time `json:"deleted_at"`
+	DeletedSku string    `json:"deleted_sku"`
+}
+
+// syncBound is the end of the changes read by a pass. updated_at has a precision of one second,
+// only the seconds ended at least settle ago are read, so the changes committed late in the same
+// second are not skipped. Transactions longer than settle can still be missed
+func syncBound(now time.Time, settle time.Duration) time.Time {
+	return now.Add(-settle).Truncate(time.Second)
+}
+
+// newSyncWatermark starts the incremental sync of an index version from its full sync
+func newSyncWatermark(start time.Time, settle time.Duration) syncWatermark {
+	bound := syncBound(start, settle)
+	return syncWatermark{UpdatedAt: bound, DeletedAt: bound}
+}
+
+func dbNow(ctx context.Context, db *sqlx.DB) (time.Time, error) {
+	var now time.Time
+	if err := db.GetContext(ctx, &now, `SELECT NOW()`); err != nil {
+		return time.Time{}, withErrorKind(errKindMySQL, err)
+	}
+	return now, nil
+}
+
+type productChange struct {
+	Sku       string    `db:"sku"`
+	Content   []byte    `db:"content"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+func getProductChanges(
+	ctx context.Context, db *sqlx.DB, wm syncWatermark, bound time.Time, limit int,
+) ([]productChange, error) {
+	query := `
+SELECT sku, content, updated_at FROM products
+WHERE (updated_at, sku) > (?, ?) AND updated_at < ?
+ORDER BY updated_at, sku LIMIT ?
+`
+	var result []productChange
+	if err := db.SelectContext(ctx, &result, query, wm.UpdatedAt, wm.Sku, bound, limit); err != nil {
+		return nil, withErrorKind(errKindMySQL, err)
+	}
+	return result, nil
+}
+
+type productDelete struct {
+	Sku       string    `db:"sku"`
+	DeletedAt time.Time `db:"deleted_at"`
+}
+
+func getProductDeletes(
+	ctx context.Context, db *sqlx.DB, wm syncWatermark, bound time.Time, limit int,
+) ([]productDelete, error) {
+	query := `
+SELECT sku, deleted_at FROM product_deletes
+WHERE (deleted_at, sku) > (?, ?) AND deleted_at < ?
+ORDER BY deleted_at, sku LIMIT ?
+`
+	var result []productDelete
+	if err := db.SelectContext(ctx, &result, query, wm.DeletedAt, wm.DeletedSku, bound, limit); err != nil {
+		return nil, withErrorKind(errKindMySQL, err)
+	}
+	return result, nil
+}
+
+// deletedSkus returns the skus not inserted again after their delete, the others are synced as changes
+func deletedSkus(ctx context.Context, db *sqlx.DB, deletes []productDelete) ([]string, error) {
+	skus := mapSlice(deletes, func(d productDelete) string {
+		return d.Sku
+	})
+	query, args, err := sqlx.In(`SELECT sku FROM products WHERE sku IN (?)`, skus)
+	if err != nil {
+		return nil, err
+	}
+
+	var existing []string
+	if err := db.SelectContext(ctx, &existing, query, args...); err != nil {
+		return nil, withErrorKind(errKindMySQL, err)
+	}
+	existed := make(map[string]struct{}, len(existing))
+	for _, sku := range existing {
+		existed[sku] = struct{}{}
+	}
+
+	result := make([]string, 0, len(skus))
+	for _, sku := range skus {
+		if _, ok := existed[sku]; !ok {
+			result = append(result, sku)
+		}
+	}
+	return result, nil
+}
+
+// oldestPending returns the time of the oldest change or delete after the watermark
+func oldestPending(ctx context.Context, db *sqlx.DB, wm syncWatermark) (time.Time, bool, error) {
+	var changed, deleted sql.NullTime
+	err := db.GetContext(ctx, &changed,
+		`SELECT MIN(updated_at) FROM products WHERE (updated_at, sku) > (?, ?)`, wm.UpdatedAt, wm.Sku)
+	if err != nil {
+		return time.Time{}, false, withErrorKind(errKindMySQL, err)
+	}
+	err = db.GetContext(ctx, &deleted,
+		`SELECT MIN(deleted_at) FROM product_deletes WHERE (deleted_at, sku) > (?, ?)`, wm.DeletedAt, wm.DeletedSku)
+	if err != nil {
+		return time.Time{}, false, withErrorKind(errKindMySQL, err)
+	}
+
+	switch {
+	case changed.Valid && deleted.Valid && deleted.Time.Before(changed.Time):
+		return deleted.Time, true, nil
+	case changed.Valid:
+		return changed.Time, true, nil
+	case deleted.Valid:
+		return deleted.Time, true, nil
+	default:
+		return time.Time{}, false, nil
+	}
+}
+
+// pruneBound returns the oldest deletes watermark of the index versions,
+// the deletes before it are synced to every version and are not read again
+func pruneBound(watermarks []syncWatermark) (time.Time, bool) {
+	if len(watermarks) == 0 {
+		return time.Time{}, false
+	}
+	bound := watermarks[0].DeletedAt
+	for _, wm := range watermarks[1:] {
+		if wm.DeletedAt.Before(bound) {
+			bound = wm.DeletedAt
+		}
+	}
+	return bound, true
+}
+
+func pruneProductDeletes(ctx context.Context, db *sqlx.DB, bound time.Time) (int64, error) {
+	result, err := db.ExecContext(ctx, `DELETE FROM product_deletes WHERE deleted_at < ?`, bound)
+	if err != nil {
+		return 0, withErrorKind(errKindMySQL, err)
+	}
+	return result.RowsAffected()
+}
+
+// pruneDeletes deletes the rows of product_deletes synced to all the index versions, including the old
+// versions kept for a rollback. Nothing is pruned while a version has no watermark, e.g. during its full sync
+func (r *ElasticRepo) pruneDeletes(ctx context.Context, live string) (int64, error) {
+	versions, err := r.getIndices(indexVersionPrefix + "*")
+	if err != nil {
+		return 0, err
+	}
+	if !containsString(versions, live) {
+		versions = append(versions, live)
+	}
+
+	watermarks := make([]syncWatermark, 0, len(versions))
+	for _, index := range versions {
+		wm, found, err := r.getWatermark(ctx, index)
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			return 0, nil
+		}
+		watermarks = append(watermarks, wm)
+	}
+
+	bound, ok := pruneBound(watermarks)
+	if !ok {
+		return 0, nil
+	}
+	return pruneProductDeletes(ctx, r.db, bound)
+}
+
+type syncMeta struct {
+	Sync *syncWatermark `json:"sync,omitempty"`
+}
+
+func (r *ElasticRepo) getWatermark(ctx context.Context, index string) (syncWatermark, bool, error) {
+	getFn := r.client.Indices.GetMapping
+	resp, err := getFn(
+		getFn.WithContext(ctx),
+		getFn.WithIndex(index),
+		getFn.WithFilterPath("*.mappings._meta"),
+	)
+	if err != nil {
+		return syncWatermark{}, false, withErrorKind(errKindElastic, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return syncWatermark{}, false, elasticStatusError(resp)
+	}
+
+	var mappings map[string]struct {
+		Mappings struct {
+			Meta syncMeta `json:"_meta"`
+		} `json:"mappings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&mappings); err != nil {
+		return syncWatermark{}, false, withErrorKind(errKindDecode, err)
+	}
+
+	wm := mappings[index].Mappings.Meta.Sync
+	if wm == nil {
+		return syncWatermark{}, false, nil
+	}
+	return *wm, true, nil
+}
+
+func (r *ElasticRepo) putWatermark(ctx context.Context, index string, wm syncWatermark) error {
+	type mappingBody struct {
+		Meta syncMeta `json:"_meta"`
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(mappingBody{Meta: syncMeta{Sync: &wm}}); err != nil {
+		return err
+	}
+
+	putFn := r.client.Indices.PutMapping
+	resp, err := putFn(&buf, putFn.WithContext(ctx), putFn.WithIndex(index))
+	if err != nil {
+		return withErrorKind(errKindElastic, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return elasticStatusError(resp)
+	}
+	return nil
+}
+
+// syncPass is the result of an incremental sync pass, Lag is the age of the oldest change not synced
+type syncPass struct {
+	Index     string
+	Upserts   int
+	Deletes   int
+	Pruned    int64
+	Lag       time.Duration
+	Watermark syncWatermark
+}
+
+// syncChanges upserts the products changed and deletes the products deleted after the watermark,
+// in the index version the alias points to. The watermark is stored after every batch,
+// a pass replays at most one batch after a failure
+func (r *ElasticRepo) syncChanges(ctx context.Context, settle time.Duration) (syncPass, error) {
+	indices, err := r.getIndices(indexName)
+	if err != nil {
+		return syncPass{}, err
+	}
+	if len(indices) != 1 {
+		return syncPass{}, fmt.Errorf("alias '%s' must point to a single index, got %v", indexName, indices)
+	}
+	// later batches of the pass go to the same version, even when a full sync switches the alias
+	index := indices[0]
+
+	wm, found, err := r.getWatermark(ctx, index)
+	if err != nil {
+		return syncPass{}, err
+	}
+	if !found {
+		return syncPass{}, fmt.Errorf("index '%s' has no sync watermark, run a full sync first", index)
+	}
+
+	now, err := dbNow(ctx, r.db)
+	if err != nil {
+		return syncPass{}, err
+	}
+	bound := syncBound(now, settle)
+	pass := syncPass{Index: index}
+
+	for {
+		changes, err := getProductChanges(ctx, r.db, wm, bound, syncBatchSize)
+		if err != nil {
+			return syncPass{}, err
+		}
+		if len(changes) == 0 {
+			break
+		}
+
+		products, err := decodeProductContents(mapSlice(changes, func(c productChange) ProductContent {
+			return ProductContent{Sku: c.Sku, Content: c.Content}
+		}))
+		if err != nil {
+			return syncPass{}, err
+		}
+		if err := r.bulkToElastic(index, products, nil); err != nil {
+			return syncPass{}, err
+		}
+
+		last := lastElem(changes)
+		wm.UpdatedAt, wm.Sku = last.UpdatedAt, last.Sku
+		if err := r.putWatermark(ctx, index, wm); err != nil {
+			return syncPass{}, err
+		}
+		pass.Upserts += len(products)
+	}
+
+	for {
+		deletes, err := getProductDeletes(ctx, r.db, wm, bound, syncBatchSize)
+		if err != nil {
+			return syncPass{}, err
+		}
+		if len(deletes) == 0 {
+			break
+		}
+
+		skus, err := deletedSkus(ctx, r.db, deletes)
+		if err != nil {
+			return syncPass{}, err
+		}
+		if err := r.bulkToElastic(index, nil, skus); err != nil {
+			return syncPass{}, err
+		}
+
+		last := lastElem(deletes)
+		wm.DeletedAt, wm.DeletedSku = last.DeletedAt, last.Sku
+		if err := r.putWatermark(ctx, index, wm); err != nil {
+			return syncPass{}, err
+		}
+		pass.Deletes += len(skus)
+	}
+
+	pass.Pruned, err = r.pruneDeletes(ctx, index)
+	if err != nil {
+		return syncPass{}, err
+	}
+
+	oldest, pending, err := oldestPending(ctx, r.db, wm)
+	if err != nil {
+		return syncPass{}, err
+	}
+	if pending {
+		now, err := dbNow(ctx, r.db)
+		if err != nil {
+			return syncPass{}, err
+		}
+		pass.Lag = now.Sub(oldest)
+	}
+	pass.Watermark = wm
+	return pass, nil
+}
+
+// SyncIncremental syncs the changes after the watermark of the live index version.
+// With a zero interval it runs a single pass, otherwise it runs until the context is done,
+// logging the failed passes
+func (r *ElasticRepo) SyncIncremental(ctx context.Context, settle time.Duration, interval time.Duration) error {
+	for {
+		pass, err := r.syncChanges(ctx, settle)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil && interval == 0:
+			return err
+		case err != nil:
+			log.Println("[ERROR] incremental sync:", err)
+		default:
+			fmt.Printf("SYNC: index=%s upserts=%d deletes=%d pruned=%d lag=%s watermark=%s\n",
+				pass.Index, pass.Upserts, pass.Deletes, pass.Pruned, pass.Lag,
+				pass.Watermark.UpdatedAt.Format(time.RFC3339))
+		}
+
+		if interval == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
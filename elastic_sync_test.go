@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/QuangTung97/memproxy/fake"
+	"github.com/jmoiron/sqlx"
+
+	"bench-multiget/pb"
+)
+
+// newMySQLTest connects to mysql for the tests of the queries, which are skipped without it
+func newMySQLTest(t *testing.T) *sqlx.DB {
+	db, err := sqlx.Connect("mysql", defaultBenchConfig().DSN)
+	if err != nil {
+		t.Skip("mysql is not available:", err)
+	}
+	doMigrate(db)
+	return db
+}
+
+func TestSyncBound(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 5, 700_000_000, time.UTC)
+
+	bound := syncBound(now, 2*time.Second)
+	if !bound.Equal(time.Date(2024, 3, 1, 10, 0, 3, 0, time.UTC)) {
+		t.Errorf("unexpected bound: %v", bound)
+	}
+
+	wm := newSyncWatermark(now, 2*time.Second)
+	if !wm.UpdatedAt.Equal(bound) || !wm.DeletedAt.Equal(bound) || wm.Sku != "" || wm.DeletedSku != "" {
+		t.Errorf("unexpected watermark: %+v", wm)
+	}
+}
+
+func TestPruneBound(t *testing.T) {
+	if _, ok := pruneBound(nil); ok {
+		t.Error("expected no bound without index versions")
+	}
+
+	t1 := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+	bound, ok := pruneBound([]syncWatermark{
+		{UpdatedAt: t1, DeletedAt: t2},
+		{UpdatedAt: t2, DeletedAt: t1},
+		{UpdatedAt: t2, DeletedAt: t2},
+	})
+	if !ok || !bound.Equal(t1) {
+		t.Errorf("expected the oldest deletes watermark, got %v %v", bound, ok)
+	}
+}
+
+func containsSku(skus []string, sku string) bool {
+	for _, s := range skus {
+		if s == sku {
+			return true
+		}
+	}
+	return false
+}
+
+func TestProductChanges_AndDeletes(t *testing.T) {
+	db := newMySQLTest(t)
+	repo := NewCacheRepo(db, fake.New())
+	ctx := context.Background()
+
+	start, err := dbNow(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wm := newSyncWatermark(start, time.Second)
+	bound := start.Add(time.Hour)
+
+	p := newProduct(0)
+	p.Sku = "TEST-SYNC-CHANGES"
+	if err := repo.UpsertProducts(ctx, []*pb.Product{p}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = repo.DeleteProducts(ctx, []string{p.Sku})
+	})
+
+	changes, err := getProductChanges(ctx, db, wm, bound, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsSku(mapSlice(changes, func(c productChange) string { return c.Sku }), p.Sku) {
+		t.Fatalf("expected a change of '%s'", p.Sku)
+	}
+
+	if err := repo.DeleteProducts(ctx, []string{p.Sku}); err != nil {
+		t.Fatal(err)
+	}
+	deletes, err := getProductDeletes(ctx, db, wm, bound, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skus, err := deletedSkus(ctx, db, deletes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsSku(skus, p.Sku) {
+		t.Fatalf("expected a delete of '%s'", p.Sku)
+	}
+
+	// inserted again after the delete, synced as a change only
+	if err := repo.UpsertProducts(ctx, []*pb.Product{p}); err != nil {
+		t.Fatal(err)
+	}
+	skus, err = deletedSkus(ctx, db, deletes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if containsSku(skus, p.Sku) {
+		t.Errorf("unexpected delete of '%s'", p.Sku)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+)
+
+// error kinds used for counting errors per type
+const (
+	errKindMySQL     = "mysql"
+	errKindDecode    = "decode"
+	errKindMemcached = "memcached"
+	errKindElastic   = "elastic"
+	errKindNotFound  = "not_found"
+	errKindTimeout   = "timeout"
+	errKindOther     = "other"
+)
+
+// kindError tags an error with the component it comes from
+type kindError struct {
+	kind string
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.kind + ": " + e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func withErrorKind(kind string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var ke *kindError
+	if errors.As(err, &ke) {
+		return err
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+func errorKind(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errKindTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errKindTimeout
+	}
+
+	var ke *kindError
+	if errors.As(err, &ke) {
+		return ke.kind
+	}
+	return errKindOther
+}
+
+// errorCounter counts errors per kind and keeps the first error of each kind, it is NOT thread safe
+type errorCounter struct {
+	counts  map[string]uint64
+	samples map[string]string
+}
+
+func newErrorCounter() *errorCounter {
+	return &errorCounter{
+		counts:  map[string]uint64{},
+		samples: map[string]string{},
+	}
+}
+
+func (c *errorCounter) add(prefix string, err error) {
+	kind := prefix + errorKind(err)
+	c.counts[kind]++
+	if _, existed := c.samples[kind]; !existed {
+		c.samples[kind] = err.Error()
+	}
+}
+
+func (c *errorCounter) merge(other *errorCounter) {
+	for kind, count := range other.counts {
+		c.counts[kind] += count
+	}
+	for kind, sample := range other.samples {
+		if _, existed := c.samples[kind]; !existed {
+			c.samples[kind] = sample
+		}
+	}
+}
+
+func (c *errorCounter) total() uint64 {
+	var total uint64
+	for _, count := range c.counts {
+		total += count
+	}
+	return total
+}
+
+func (c *errorCounter) kinds() []string {
+	result := make([]string, 0, len(c.counts))
+	for kind := range c.counts {
+		result = append(result, kind)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// histogram buckets are log-linear like HdrHistogram: values below subBucketCount are recorded exactly,
+// larger values are grouped into buckets with relative error at most 1 / subBucketHalfCount (~1.5%)
+const (
+	subBucketBits      = 7
+	subBucketCount     = 1 << subBucketBits
+	subBucketHalfCount = subBucketCount / 2
+
+	histogramNumBuckets = (64-subBucketBits)*subBucketHalfCount + subBucketCount
+)
+
+// Histogram records latencies in nanoseconds, it is NOT thread safe,
+// each worker should use its own Histogram and merge them at the end
+type Histogram struct {
+	counts [histogramNumBuckets]uint64
+
+	count uint64
+	sum   uint64
+	min   uint64
+	max   uint64
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{
+		min: math.MaxUint64,
+	}
+}
+
+func histogramBucketIndex(v uint64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+	shift := bits.Len64(v) - subBucketBits
+	return shift*subBucketHalfCount + int(v>>shift)
+}
+
+// histogramBucketUpperBound returns the highest value that is recorded into the bucket
+func histogramBucketUpperBound(index int) uint64 {
+	if index < subBucketCount {
+		return uint64(index)
+	}
+	shift := index/subBucketHalfCount - 1
+	sub := uint64(index - shift*subBucketHalfCount)
+	return (sub+1)<<shift - 1
+}
+
+func (h *Histogram) RecordValue(v uint64) {
+	h.counts[histogramBucketIndex(v)]++
+	h.count++
+	h.sum += v
+	if v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.RecordValue(uint64(d))
+}
+
+func (h *Histogram) Merge(other *Histogram) {
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	h.count += other.count
+	h.sum += other.sum
+	if other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+func (h *Histogram) Count() uint64 {
+	return h.count
+}
+
+func (h *Histogram) Min() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return time.Duration(h.min)
+}
+
+func (h *Histogram) Max() time.Duration {
+	return time.Duration(h.max)
+}
+
+func (h *Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return time.Duration(h.sum / h.count)
+}
+
+// ValueAtQuantile returns the smallest recorded value that q (in range [0, 1]) of all values are less than or equal to
+func (h *Histogram) ValueAtQuantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(q * float64(h.count)))
+	if target == 0 {
+		target = 1
+	}
+
+	var accum uint64
+	for i, c := range h.counts {
+		accum += c
+		if accum >= target {
+			v := histogramBucketUpperBound(i)
+			if v > h.max {
+				v = h.max
+			}
+			return time.Duration(v)
+		}
+	}
+	return time.Duration(h.max)
+}
+
+type latencyPercentile struct {
+	name     string
+	quantile float64
+}
+
+var reportedPercentiles = []latencyPercentile{
+	{name: "p50", quantile: 0.5},
+	{name: "p90", quantile: 0.9},
+	{name: "p99", quantile: 0.99},
+	{name: "p999", quantile: 0.999},
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogramBucketIndex(t *testing.T) {
+	prevIndex := -1
+	for _, v := range []uint64{0, 1, 127, 128, 129, 255, 256, 1000, 1 << 20, 1<<40 + 12345, 1<<63 + 1} {
+		index := histogramBucketIndex(v)
+		if index < prevIndex {
+			t.Errorf("bucket index decreasing at %d", v)
+		}
+		if index >= histogramNumBuckets {
+			t.Fatalf("bucket index out of range at %d", v)
+		}
+		prevIndex = index
+
+		upper := histogramBucketUpperBound(index)
+		if upper < v {
+			t.Errorf("upper bound %d less than value %d", upper, v)
+		}
+		if float64(upper-v) > float64(v)/subBucketHalfCount {
+			t.Errorf("upper bound %d too far from value %d", upper, v)
+		}
+	}
+}
+
+func TestHistogramPercentiles(t *testing.T) {
+	h := NewHistogram()
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+
+	if h.Count() != 1000 {
+		t.Errorf("unexpected count: %d", h.Count())
+	}
+	if h.Max() != time.Millisecond {
+		t.Errorf("unexpected max: %v", h.Max())
+	}
+	if h.Min() != time.Microsecond {
+		t.Errorf("unexpected min: %v", h.Min())
+	}
+
+	assertNear := func(name string, d time.Duration, expected time.Duration) {
+		t.Helper()
+		diff := d - expected
+		if diff < 0 || float64(diff) > float64(expected)/subBucketHalfCount {
+			t.Errorf("%s = %v, expected near %v", name, d, expected)
+		}
+	}
+	assertNear("p50", h.ValueAtQuantile(0.5), 500*time.Microsecond)
+	assertNear("p99", h.ValueAtQuantile(0.99), 990*time.Microsecond)
+	assertNear("p100", h.ValueAtQuantile(1), time.Millisecond)
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a := NewHistogram()
+	b := NewHistogram()
+	for i := 1; i <= 100; i++ {
+		a.Record(time.Duration(i))
+		b.Record(time.Duration(i + 100))
+	}
+
+	merged := NewHistogram()
+	merged.Merge(a)
+	merged.Merge(b)
+
+	if merged.Count() != 200 {
+		t.Errorf("unexpected count: %d", merged.Count())
+	}
+	if merged.Min() != 1 || merged.Max() != 200 {
+		t.Errorf("unexpected min max: %v %v", merged.Min(), merged.Max())
+	}
+	if merged.ValueAtQuantile(0.5) != 100 {
+		t.Errorf("unexpected p50: %v", merged.ValueAtQuantile(0.5))
+	}
+	if merged.Mean() != 100 {
+		t.Errorf("unexpected mean: %v", merged.Mean())
+	}
+}
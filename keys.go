@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+const (
+	distSequential = "sequential"
+	distUniform    = "uniform"
+	distZipf       = "zipf"
+	distHotspot    = "hotspot"
+)
+
+// KeySelector chooses the skus of each multi get batch, it is NOT thread safe
+type KeySelector interface {
+	// NextBatch appends the skus of the next batch to dst[:0]
+	NextBatch(dst []string) []string
+}
+
+type keyDistConfig struct {
+	Distribution string
+
+	// ZipfS is the s parameter of the zipf distribution, must be > 1
+	ZipfS float64
+
+	// HotKeys is the fraction of keys in the hot set, HotRatio is the fraction of accesses going to the hot set
+	HotKeys  float64
+	HotRatio float64
+}
+
+func defaultKeyDistConfig() keyDistConfig {
+	return keyDistConfig{
+		Distribution: distSequential,
+		ZipfS:        1.1,
+		HotKeys:      0.2,
+		HotRatio:     0.8,
+	}
+}
+
+func (c keyDistConfig) validate() error {
+	switch c.Distribution {
+	case distSequential, distUniform:
+	case distZipf:
+		if c.ZipfS <= 1 {
+			return fmt.Errorf("zipf s must be greater than 1, got %v", c.ZipfS)
+		}
+	case distHotspot:
+		if c.HotKeys <= 0 || c.HotKeys >= 1 {
+			return fmt.Errorf("hot keys must be in range (0, 1), got %v", c.HotKeys)
+		}
+		if c.HotRatio < 0 || c.HotRatio > 1 {
+			return fmt.Errorf("hot ratio must be in range [0, 1], got %v", c.HotRatio)
+		}
+	default:
+		return fmt.Errorf("unknown key distribution '%s', must be one of: %s, %s, %s, %s",
+			c.Distribution, distSequential, distUniform, distZipf, distHotspot)
+	}
+	return nil
+}
+
+// newKeySelector creates a selector using its own random source, so that each worker can have one
+func newKeySelector(conf keyDistConfig, allSkus []string, batchSize int, seed int64) KeySelector {
+	r := rand.New(rand.NewSource(seed))
+
+	switch conf.Distribution {
+	case distUniform:
+		return &randomKeySelector{
+			allSkus:   allSkus,
+			batchSize: batchSize,
+			nextIndex: func() int {
+				return r.Intn(len(allSkus))
+			},
+		}
+
+	case distZipf:
+		zipf := rand.NewZipf(r, conf.ZipfS, 1, uint64(len(allSkus)-1))
+		return &randomKeySelector{
+			allSkus:   allSkus,
+			batchSize: batchSize,
+			nextIndex: func() int {
+				return int(zipf.Uint64())
+			},
+		}
+
+	case distHotspot:
+		numHot := int(float64(len(allSkus)) * conf.HotKeys)
+		if numHot < 1 {
+			numHot = 1
+		}
+		return &randomKeySelector{
+			allSkus:   allSkus,
+			batchSize: batchSize,
+			nextIndex: func() int {
+				if r.Float64() < conf.HotRatio {
+					return r.Intn(numHot)
+				}
+				return numHot + r.Intn(len(allSkus)-numHot)
+			},
+		}
+
+	default:
+		return &sequentialKeySelector{
+			rand:       r,
+			allSkus:    allSkus,
+			batchSize:  batchSize,
+			numBatches: len(allSkus) / batchSize,
+		}
+	}
+}
+
+// sequentialKeySelector picks a random aligned range of contiguous skus
+type sequentialKeySelector struct {
+	rand       *rand.Rand
+	allSkus    []string
+	batchSize  int
+	numBatches int
+}
+
+func (s *sequentialKeySelector) NextBatch(dst []string) []string {
+	index := s.rand.Intn(s.numBatches) * s.batchSize
+	return append(dst[:0], s.allSkus[index:index+s.batchSize]...)
+}
+
+// randomKeySelector picks each sku of a batch independently, skus in a batch are distinct
+// unless the distribution is too skewed to find enough distinct skus
+type randomKeySelector struct {
+	allSkus   []string
+	batchSize int
+	nextIndex func() int
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *randomKeySelector) NextBatch(dst []string) []string {
+	dst = dst[:0]
+
+	maxAttempts := 64 * s.batchSize
+	for attempt := 0; len(dst) < s.batchSize; attempt++ {
+		sku := s.allSkus[s.nextIndex()]
+		if attempt < maxAttempts && containsString(dst, sku) {
+			continue
+		}
+		dst = append(dst, sku)
+	}
+	return dst
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+)
+
+func countKeyAccesses(t *testing.T, conf keyDistConfig, numBatches int) map[string]int {
+	t.Helper()
+
+	allSkus := newAllSkus(1000)
+	selector := newKeySelector(conf, allSkus, 20, 1)
+
+	counts := map[string]int{}
+	var batch []string
+	for i := 0; i < numBatches; i++ {
+		batch = selector.NextBatch(batch)
+		if len(batch) != 20 {
+			t.Fatalf("unexpected batch size: %d", len(batch))
+		}
+
+		seen := map[string]struct{}{}
+		for _, sku := range batch {
+			if _, existed := seen[sku]; existed {
+				t.Fatalf("duplicated sku in batch: %s", sku)
+			}
+			seen[sku] = struct{}{}
+			counts[sku]++
+		}
+	}
+	return counts
+}
+
+func TestKeySelector_Sequential(t *testing.T) {
+	conf := defaultKeyDistConfig()
+
+	allSkus := newAllSkus(1000)
+	selector := newKeySelector(conf, allSkus, 20, 1)
+
+	batch := selector.NextBatch(nil)
+	first := -1
+	for i, sku := range allSkus {
+		if sku == batch[0] {
+			first = i
+		}
+	}
+	if first%20 != 0 {
+		t.Fatalf("batch not aligned: %d", first)
+	}
+	for i, sku := range batch {
+		if sku != allSkus[first+i] {
+			t.Errorf("batch not contiguous at %d", i)
+		}
+	}
+}
+
+func TestKeySelector_Uniform(t *testing.T) {
+	conf := defaultKeyDistConfig()
+	conf.Distribution = distUniform
+
+	counts := countKeyAccesses(t, conf, 1000)
+	if len(counts) < 990 {
+		t.Errorf("expected nearly all keys accessed, got %d", len(counts))
+	}
+}
+
+func TestKeySelector_Zipf(t *testing.T) {
+	conf := defaultKeyDistConfig()
+	conf.Distribution = distZipf
+
+	counts := countKeyAccesses(t, conf, 1000)
+
+	// the hottest key should be in nearly every batch
+	if counts["SKU0000001"] < 900 {
+		t.Errorf("expected skewed accesses, hottest key count: %d", counts["SKU0000001"])
+	}
+}
+
+func TestKeySelector_Hotspot(t *testing.T) {
+	conf := defaultKeyDistConfig()
+	conf.Distribution = distHotspot
+	conf.HotKeys = 0.1
+	conf.HotRatio = 0.5
+
+	counts := countKeyAccesses(t, conf, 1000)
+
+	hot := 0
+	total := 0
+	for sku, c := range counts {
+		if sku <= "SKU0000100" {
+			hot += c
+		}
+		total += c
+	}
+
+	ratio := float64(hot) / float64(total)
+	if ratio < 0.45 || ratio > 0.55 {
+		t.Errorf("unexpected hot ratio: %v", ratio)
+	}
+}
+
+func TestKeyDistConfig_Validate(t *testing.T) {
+	conf := defaultKeyDistConfig()
+	conf.Distribution = distZipf
+	conf.ZipfS = 1
+	if conf.validate() == nil {
+		t.Error("expected error for zipf s = 1")
+	}
+
+	conf = defaultKeyDistConfig()
+	conf.Distribution = "normal"
+	if conf.validate() == nil {
+		t.Error("expected error for unknown distribution")
+	}
+}
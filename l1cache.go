@@ -0,0 +1,258 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"bench-multiget/pb"
+)
+
+const (
+	l1PolicyNone    = "none"
+	l1PolicyLRU     = "lru"
+	l1PolicyTinyLFU = "tinylfu"
+)
+
+var l1PolicyNames = []string{l1PolicyNone, l1PolicyLRU, l1PolicyTinyLFU}
+
+func validateL1Policy(name string) error {
+	for _, n := range l1PolicyNames {
+		if n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown l1 policy '%s', must be one of: %s", name, strings.Join(l1PolicyNames, ", "))
+}
+
+const l1NumShards = 64
+
+// l1Cache is a bounded in-process cache of products, and of not found skus.
+// It is thread safe, the cached products are shared and MUST NOT be modified by callers
+type l1Cache struct {
+	ttl    time.Duration
+	shards [l1NumShards]l1Shard
+}
+
+type l1Entry struct {
+	key      string
+	product  *pb.Product
+	expireAt time.Time
+}
+
+type l1Shard struct {
+	mut      sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List
+
+	// sketch is nil for the lru policy
+	sketch *frequencySketch
+
+	// generation is incremented by every delete, see fill
+	generation uint64
+}
+
+// newL1Cache creates a cache of size entries, a zero ttl means no expiry
+func newL1Cache(policy string, size int, ttl time.Duration) *l1Cache {
+	c := &l1Cache{ttl: ttl}
+
+	capacity := (size + l1NumShards - 1) / l1NumShards
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.capacity = capacity
+		s.entries = make(map[string]*list.Element, capacity)
+		s.lru = list.New()
+		if policy == l1PolicyTinyLFU {
+			s.sketch = newFrequencySketch(capacity)
+		}
+	}
+	return c
+}
+
+func hashKey(key string) uint64 {
+	// FNV-1a
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (c *l1Cache) getShard(h uint64) *l1Shard {
+	return &c.shards[h%l1NumShards]
+}
+
+// get returns the cached product, a nil product with ok = true means the sku is not found
+func (c *l1Cache) get(sku string, now time.Time) (product *pb.Product, ok bool) {
+	h := hashKey(sku)
+	s := c.getShard(h)
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.sketch != nil {
+		s.sketch.increment(h)
+	}
+
+	elem, existed := s.entries[sku]
+	if !existed {
+		return nil, false
+	}
+
+	entry := elem.Value.(*l1Entry)
+	if !entry.expireAt.IsZero() && !now.Before(entry.expireAt) {
+		s.lru.Remove(elem)
+		delete(s.entries, sku)
+		return nil, false
+	}
+
+	s.lru.MoveToFront(elem)
+	return entry.product, true
+}
+
+// generation returns the invalidation generation of the sku, taken before reading the product from memcached
+func (c *l1Cache) generation(sku string) uint64 {
+	s := c.getShard(hashKey(sku))
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return s.generation
+}
+
+// fill sets a product read from memcached, unless a delete happened since its generation was taken,
+// otherwise a read started before an invalidation would set the old product back.
+// The generation is per shard, a delete of another sku of the shard also skips the fill
+func (c *l1Cache) fill(sku string, product *pb.Product, now time.Time, generation uint64) {
+	h := hashKey(sku)
+	s := c.getShard(h)
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.generation != generation {
+		return
+	}
+
+	var expireAt time.Time
+	if c.ttl > 0 {
+		expireAt = now.Add(c.ttl)
+	}
+
+	if elem, existed := s.entries[sku]; existed {
+		entry := elem.Value.(*l1Entry)
+		entry.product = product
+		entry.expireAt = expireAt
+		s.lru.MoveToFront(elem)
+		return
+	}
+
+	if s.lru.Len() >= s.capacity {
+		victim := s.lru.Back()
+		victimKey := victim.Value.(*l1Entry).key
+
+		// tinylfu admission: only replace the victim by a more frequently accessed key
+		if s.sketch != nil && s.sketch.estimate(h) <= s.sketch.estimate(hashKey(victimKey)) {
+			return
+		}
+		s.lru.Remove(victim)
+		delete(s.entries, victimKey)
+	}
+
+	s.entries[sku] = s.lru.PushFront(&l1Entry{
+		key:      sku,
+		product:  product,
+		expireAt: expireAt,
+	})
+}
+
+func (c *l1Cache) delete(sku string) {
+	s := c.getShard(hashKey(sku))
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.generation++
+	if elem, existed := s.entries[sku]; existed {
+		s.lru.Remove(elem)
+		delete(s.entries, sku)
+	}
+}
+
+// frequencySketch is a count-min sketch of 4 bit counters, all counters are halved
+// after a sample of 10 * capacity increments, so old accesses are forgotten
+type frequencySketch struct {
+	counters   [frequencySketchDepth][]uint8
+	shift      uint
+	additions  int
+	sampleSize int
+}
+
+const (
+	frequencySketchDepth = 4
+	frequencyMax         = 15
+)
+
+func newFrequencySketch(capacity int) *frequencySketch {
+	width := 16
+	shift := uint(64 - 4)
+	for width < capacity {
+		width *= 2
+		shift--
+	}
+
+	s := &frequencySketch{
+		shift:      shift,
+		sampleSize: 10 * capacity,
+	}
+	for i := range s.counters {
+		s.counters[i] = make([]uint8, width)
+	}
+	return s
+}
+
+var frequencySketchSeeds = [frequencySketchDepth]uint64{
+	0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325,
+}
+
+func (s *frequencySketch) index(h uint64, row int) uint64 {
+	// multiplicative hashing keeps the high bits, the low bits of h are the same for every key of a shard
+	return ((h ^ frequencySketchSeeds[row]) * 0x9e3779b97f4a7c15) >> s.shift
+}
+
+func (s *frequencySketch) increment(h uint64) {
+	for i := range s.counters {
+		idx := s.index(h, i)
+		if s.counters[i][idx] < frequencyMax {
+			s.counters[i][idx]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+func (s *frequencySketch) estimate(h uint64) uint8 {
+	result := uint8(frequencyMax)
+	for i := range s.counters {
+		if v := s.counters[i][s.index(h, i)]; v < result {
+			result = v
+		}
+	}
+	return result
+}
+
+func (s *frequencySketch) reset() {
+	s.additions = 0
+	for i := range s.counters {
+		for j := range s.counters[i] {
+			s.counters[i][j] /= 2
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"bench-multiget/pb"
+)
+
+func TestL1Cache_TTL(t *testing.T) {
+	c := newL1Cache(l1PolicyLRU, 100, time.Second)
+	now := time.Now()
+
+	c.fill("SKU01", &pb.Product{Sku: "SKU01"}, now, c.generation("SKU01"))
+	c.fill("SKU02", nil, now, c.generation("SKU02"))
+
+	if p, ok := c.get("SKU01", now.Add(999*time.Millisecond)); !ok || p.Sku != "SKU01" {
+		t.Errorf("expected hit, got %v %v", p, ok)
+	}
+	if p, ok := c.get("SKU02", now); !ok || p != nil {
+		t.Errorf("expected not found hit, got %v %v", p, ok)
+	}
+	if _, ok := c.get("SKU01", now.Add(time.Second)); ok {
+		t.Error("expected expired entry")
+	}
+
+	c.delete("SKU02")
+	if _, ok := c.get("SKU02", now); ok {
+		t.Error("expected deleted entry")
+	}
+}
+
+func TestL1Cache_FillAfterDelete(t *testing.T) {
+	c := newL1Cache(l1PolicyLRU, 100, time.Second)
+	now := time.Now()
+
+	c.fill("SKU01", &pb.Product{Sku: "SKU01", Name: "old"}, now, c.generation("SKU01"))
+
+	// the memcached read starts before the invalidation and ends after it
+	generation := c.generation("SKU01")
+	c.delete("SKU01")
+	c.fill("SKU01", &pb.Product{Sku: "SKU01", Name: "old"}, now, generation)
+
+	if p, ok := c.get("SKU01", now); ok {
+		t.Errorf("expected the fill to be skipped, got %v", p)
+	}
+
+	c.fill("SKU01", &pb.Product{Sku: "SKU01", Name: "new"}, now, c.generation("SKU01"))
+	if p, ok := c.get("SKU01", now); !ok || p.Name != "new" {
+		t.Errorf("expected hit, got %v %v", p, ok)
+	}
+}
+
+// keysOfShard returns the first n keys belonging to the shard
+func keysOfShard(c *l1Cache, shard int, n int) []string {
+	var keys []string
+	for i := 0; len(keys) < n; i++ {
+		key := fmt.Sprintf("SKU%07d", i)
+		if c.getShard(hashKey(key)) == &c.shards[shard] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestL1Cache_LRUEviction(t *testing.T) {
+	c := newL1Cache(l1PolicyLRU, 2*l1NumShards, 0)
+	keys := keysOfShard(c, 3, 3)
+	now := time.Now()
+
+	c.fill(keys[0], &pb.Product{}, now, c.generation(keys[0]))
+	c.fill(keys[1], &pb.Product{}, now, c.generation(keys[1]))
+	c.get(keys[0], now)
+	c.fill(keys[2], &pb.Product{}, now, c.generation(keys[2]))
+
+	if _, ok := c.get(keys[1], now); ok {
+		t.Error("expected least recently used key evicted")
+	}
+	if _, ok := c.get(keys[0], now); !ok {
+		t.Error("expected recently used key kept")
+	}
+}
+
+func TestL1Cache_TinyLFUAdmission(t *testing.T) {
+	c := newL1Cache(l1PolicyTinyLFU, 2*l1NumShards, 0)
+	keys := keysOfShard(c, 5, 4)
+	now := time.Now()
+
+	for i := 0; i < 5; i++ {
+		c.get(keys[0], now)
+		c.get(keys[1], now)
+	}
+	c.fill(keys[0], &pb.Product{}, now, c.generation(keys[0]))
+	c.fill(keys[1], &pb.Product{}, now, c.generation(keys[1]))
+
+	// accessed once, less frequent than the victim
+	c.get(keys[2], now)
+	c.fill(keys[2], &pb.Product{}, now, c.generation(keys[2]))
+	if _, ok := c.get(keys[2], now); ok {
+		t.Error("expected infrequent key rejected")
+	}
+
+	for i := 0; i < 10; i++ {
+		c.get(keys[3], now)
+	}
+	c.fill(keys[3], &pb.Product{}, now, c.generation(keys[3]))
+	if _, ok := c.get(keys[3], now); !ok {
+		t.Error("expected frequent key admitted")
+	}
+}
@@ -2,13 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"math/rand"
-	"sync"
-	"sync/atomic"
-	"time"
+	"os"
 
-	"github.com/QuangTung97/memproxy/proxy"
 	"github.com/jmoiron/sqlx"
 
 	"bench-multiget/pb"
@@ -27,6 +25,10 @@ CREATE TABLE IF NOT EXISTS products (
 
 func doMigrate(db *sqlx.DB) {
 	db.MustExec(createTableSQL)
+	for _, query := range createEntityTablesSQL {
+		db.MustExec(query)
+	}
+	migrateSyncTables(db)
 }
 
 func repeatSlice[T any](e T, n int) []T {
@@ -47,155 +49,102 @@ func withIndex[T any](num int, fn func(i int) T) []T {
 
 const numProducts = 10_000
 
-func insertProducts(db *sqlx.DB) {
+func newProduct(i int) *pb.Product {
+	return &pb.Product{
+		Sku:         fmt.Sprintf("SKU%07d", i+1),
+		Name:        fmt.Sprintf("Product Name %d", i+1),
+		DisplayName: fmt.Sprintf("Display Name %d", i+1),
+		Desc:        fmt.Sprintf("Product Description %d", i+1),
+		Attributes: repeatSlice(&pb.Attribute{
+			Id:   int64(i + 1),
+			Code: fmt.Sprintf("ATTR_CODE_%07d", i+1),
+			Name: fmt.Sprintf("Attribute Name %d", i+1),
+		}, 200),
+		Brand: &pb.Brand{
+			Id:   int64(i + 1),
+			Code: fmt.Sprintf("BRAND_CODE_%07d", i+1),
+			Name: fmt.Sprintf("Brand Name %d", i+1),
+		},
+	}
+}
+
+func insertProducts(db *sqlx.DB, numProducts int) error {
 	repo := NewCacheRepo(db, nil)
 
 	products := make([]*pb.Product, 0, numProducts)
 	for i := 0; i < numProducts; i++ {
-		products = append(products, &pb.Product{
-			Sku:         fmt.Sprintf("SKU%07d", i+1),
-			Name:        fmt.Sprintf("Product Name %d", i+1),
-			DisplayName: fmt.Sprintf("Display Name %d", i+1),
-			Desc:        fmt.Sprintf("Product Description %d", i+1),
-			Attributes: repeatSlice(&pb.Attribute{
-				Id:   int64(i + 1),
-				Code: fmt.Sprintf("ATTR_CODE_%07d", i+1),
-				Name: fmt.Sprintf("Attribute Name %d", i+1),
-			}, 200),
-			Brand: &pb.Brand{
-				Id:   int64(i + 1),
-				Code: fmt.Sprintf("BRAND_CODE_%07d", i+1),
-				Name: fmt.Sprintf("Brand Name %d", i+1),
-			},
-		})
-	}
-
-	repo.InsertProducts(context.Background(), products)
+		products = append(products, newProduct(i))
+	}
+
+	return repo.InsertProducts(context.Background(), products)
 }
 
-func benchMultiGetFromCache(db *sqlx.DB) {
-	servers := []proxy.SimpleServerConfig{
-		{
-			ID:   1,
-			Host: "localhost",
-			Port: 11211,
-		},
+func benchMultiGetFromCache(db *sqlx.DB, conf benchConfig) (benchResult, error) {
+	servers, err := parseMemcachedServers(conf.MemcachedServers)
+	if err != nil {
+		return benchResult{}, err
 	}
-
-	statsClient := proxy.NewSimpleStats(servers)
-	client, shutdownFunc, err := proxy.NewSimpleReplicatedMemcache(servers,
-		4,
-		statsClient,
-	)
+	codec, err := newCodec[*pb.Product](conf.Codec)
 	if err != nil {
-		panic(err)
+		return benchResult{}, err
 	}
-	defer shutdownFunc()
-
-	repo := NewCacheRepo(db, client)
-
-	allSkus := withIndex(numProducts, func(i int) string {
-		return fmt.Sprintf("SKU%07d", i+1)
-	})
-
-	const numThreads = 8
-	const numSkusPerBatch = 40
-	const numBatches = numProducts / numSkusPerBatch
-
-	const numLoops = 10_000
-
-	start := time.Now()
-
-	var wg sync.WaitGroup
-	wg.Add(numThreads)
-
-	stats := Stats{}
-
-	for th := 0; th < numThreads; th++ {
-		go func() {
-			defer wg.Done()
-
-			for i := 0; i < numLoops; i++ {
-				index := rand.Intn(numBatches) * numSkusPerBatch
-				skus := allSkus[index : index+numSkusPerBatch]
-				products := repo.GetProducts(context.Background(), skus, &stats)
-				if products[0].Sku == "" {
-					panic("Not found product")
-				}
-			}
-		}()
+	compressor, err := newCompressor(conf.Compression)
+	if err != nil {
+		return benchResult{}, err
 	}
 
-	wg.Wait()
-
-	d := time.Since(start)
-	fmt.Println("TOTAL TIME:", d)
-	fmt.Println("BATCH SIZE:", numSkusPerBatch)
-	fmt.Println("TOTAL THREADS:", numThreads)
-	fmt.Println("TOTAL KEYS:", numThreads*numLoops*numSkusPerBatch)
-	fmt.Println("TOTAL MISSES:", stats.MissCount.Load())
-	fmt.Println("TOTAL HITS:", stats.HitCount.Load())
+	cluster, err := newMemcacheCluster(conf.Topology, servers, conf.MemcachedConns)
+	if err != nil {
+		return benchResult{}, withErrorKind(errKindMemcached, err)
+	}
+	defer cluster.Close()
+
+	options := []CacheRepoOption{
+		WithKeyPrefix(conf.KeyNamespace, productSchemaVersion(conf.KeyVersion)),
+		WithTTL(conf.TTL),
+		WithSoftTTL(conf.SoftTTL),
+		WithNegativeTTL(conf.NegativeTTL),
+		WithCodec(codec),
+		WithCompression(compressor),
+	}
+	if conf.Model == modelNormalized {
+		options = append(options, WithNormalizedModel())
+	}
+	if conf.L1Policy != l1PolicyNone {
+		options = append(options, WithL1Cache(newL1Cache(conf.L1Policy, conf.L1Size, conf.L1TTL)))
+	}
 
-	getsPerSecond := numThreads * numLoops * numSkusPerBatch / d.Seconds()
-	fmt.Println("GETS per Second:", getsPerSecond)
+	repo := NewCacheRepo(db, cluster.client, options...)
+	// deferred after cluster.Close, so the refreshes are done before the cluster is closed
+	defer repo.Close()
 
-	fmt.Println("TOTAL BYTES:", stats.TotalBytes.Load())
-	bytesPerSecond := float64(stats.TotalBytes.Load()) / d.Seconds()
-	fmt.Println("MB per second:", bytesPerSecond/1024/1024)
-	fmt.Println("Mb per second:", bytesPerSecond*8/1024/1024)
+	result, err := runMultiGet(repo, backendCache, conf)
+	if err != nil {
+		return benchResult{}, err
+	}
+	result.Servers = cluster.serverResults()
+	return result, nil
 }
 
-func benchMultiGetFromElastic(db *sqlx.DB) {
-	repo := NewElasticRepo(db, "http://localhost:9200")
-
-	allSkus := withIndex(numProducts, func(i int) string {
-		return fmt.Sprintf("SKU%07d", i+1)
-	})
-
-	const numThreads = 10
-	const numSkusPerBatch = 20
-	const numBatches = numProducts / numSkusPerBatch
-
-	const numLoops = 10_000
-
-	start := time.Now()
-	var wg sync.WaitGroup
-	wg.Add(numThreads)
-
-	var totalBytes atomic.Uint64
-
-	for th := 0; th < numThreads; th++ {
-		go func() {
-			defer wg.Done()
-
-			for i := 0; i < numLoops; i++ {
-				index := rand.Intn(numBatches) * numSkusPerBatch
-				skus := allSkus[index : index+numSkusPerBatch]
-				_ = repo.GetProducts(skus, &totalBytes)
-			}
-		}()
+func benchMultiGetFromElastic(db *sqlx.DB, conf benchConfig) (benchResult, error) {
+	repo, err := NewElasticRepo(db, conf.ESAddr,
+		WithESMethod(conf.ESMethod),
+		WithESProjection(conf.ESProjection),
+		WithESDecoder(conf.ESDecoder),
+	)
+	if err != nil {
+		return benchResult{}, err
 	}
-	wg.Wait()
-
-	d := time.Since(start)
-	fmt.Println("TOTAL TIME:", d)
-	fmt.Println("TOTAL THREADS:", numThreads)
-	fmt.Println("BATCH SIZE:", numSkusPerBatch)
-	fmt.Println("TOTAL KEYS:", numThreads*numLoops*numSkusPerBatch)
-	fmt.Println("TOTAL BYTES:", totalBytes.Load())
-	fmt.Println("GETS per Second:", numThreads*numLoops*numSkusPerBatch/d.Seconds())
+	return runMultiGet(repo, backendElastic, conf)
 }
 
 func main() {
-	db := sqlx.MustConnect("mysql", "root:1@tcp(localhost:3306)/bench?parseTime=true")
-	// doMigrate(db)
-	// insertProducts(db)
-	benchMultiGetFromCache(db)
-	// r.SyncProducts()
-	// benchMultiGetFromElastic(db)
-
-	//var totalBytes atomic.Uint64
-	//repo := NewElasticRepo(db, "http://localhost:9200")
-	//products := repo.GetProducts([]string{"SKU0001350"}, &totalBytes)
-	//fmt.Println(products[0])
+	err := runCommand(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		os.Exit(1)
+	}
 }
@@ -9,5 +9,7 @@ import (
 
 func TestBenchmarkGetFromCache(t *testing.T) {
 	db := sqlx.MustConnect("mysql", "root:1@tcp(localhost:3306)/bench?parseTime=true")
-	benchMultiGetFromCache(db)
+	if _, err := benchMultiGetFromCache(db, defaultBenchConfig()); err != nil {
+		t.Fatal(err)
+	}
 }
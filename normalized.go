@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/QuangTung97/memproxy"
+	"github.com/QuangTung97/memproxy/item"
+
+	"bench-multiget/pb"
+)
+
+const (
+	// modelDenormalized caches each product with its brand and its attributes embedded
+	modelDenormalized = "denormalized"
+
+	// modelNormalized caches slim products referencing the brands and the attributes by id,
+	// which are cached once per id
+	modelNormalized = "normalized"
+)
+
+var modelNames = []string{modelDenormalized, modelNormalized}
+
+func validateModel(name string) error {
+	for _, n := range modelNames {
+		if n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown model '%s', must be one of: %s", name, strings.Join(modelNames, ", "))
+}
+
+var createEntityTablesSQL = []string{`
+CREATE TABLE IF NOT EXISTS brands (
+    id BIGINT NOT NULL PRIMARY KEY,
+    content JSON NOT NULL
+)
+`, `
+CREATE TABLE IF NOT EXISTS attributes (
+    id BIGINT NOT NULL PRIMARY KEY,
+    content JSON NOT NULL
+)
+`}
+
+// entityMessage is a brand or an attribute
+type entityMessage interface {
+	ProtoMessage
+	GetId() int64
+}
+
+const (
+	entityKindBrand     = "b"
+	entityKindAttribute = "a"
+)
+
+type EntityCacheKey struct {
+	Prefix string
+	Format string
+	Kind   string
+	ID     int64
+}
+
+func (k EntityCacheKey) String() string {
+	if k.Format == "" {
+		return fmt.Sprintf("%s%s/%d", k.Prefix, k.Kind, k.ID)
+	}
+	return fmt.Sprintf("%s%s:%s/%d", k.Prefix, k.Kind, k.Format, k.ID)
+}
+
+// entityFormat is the format of the products applied to another entity type
+func entityFormat[T ProtoMessage](f ValueFormat[*pb.Product]) ValueFormat[T] {
+	codec, err := codecByID[T](f.Codec.ID())
+	if err != nil {
+		panic(err)
+	}
+	return ValueFormat[T]{
+		Codec:       codec,
+		Compression: f.Compression,
+	}
+}
+
+// slimProduct keeps only the ids of the brand and of the attributes
+func slimProduct(p *pb.Product) *pb.Product {
+	result := &pb.Product{
+		Sku:         p.Sku,
+		Name:        p.Name,
+		DisplayName: p.DisplayName,
+		Desc:        p.Desc,
+		Attributes: mapSlice(p.Attributes, func(a *pb.Attribute) *pb.Attribute {
+			return &pb.Attribute{Id: a.Id}
+		}),
+	}
+	if p.Brand != nil {
+		result.Brand = &pb.Brand{Id: p.Brand.Id}
+	}
+	return result
+}
+
+// entityCache is the cache of a brand or an attribute table
+type entityCache[T entityMessage] struct {
+	repo    *CacheRepo
+	kind    string
+	table   string
+	newFunc func() T
+	format  ValueFormat[T]
+}
+
+func newEntityCache[T entityMessage](repo *CacheRepo, kind string, table string, newFunc func() T) *entityCache[T] {
+	return &entityCache[T]{
+		repo:    repo,
+		kind:    kind,
+		table:   table,
+		newFunc: newFunc,
+		format:  entityFormat[T](repo.options.format),
+	}
+}
+
+func (c *entityCache[T]) key(id int64) EntityCacheKey {
+	return EntityCacheKey{
+		Prefix: c.repo.options.keyPrefix,
+		Format: c.format.Name(),
+		Kind:   c.kind,
+		ID:     id,
+	}
+}
+
+type entityContent struct {
+	ID      int64  `db:"id"`
+	Content []byte `db:"content"`
+}
+
+func (c *entityCache[T]) load(ctx context.Context, keys []EntityCacheKey) ([]CacheValue[T], error) {
+	ids := mapSlice(keys, func(k EntityCacheKey) int64 {
+		return k.ID
+	})
+	contents, err := c.repo.store.GetEntities(ctx, c.table, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]CacheValue[T], 0, len(contents))
+	for _, e := range contents {
+		v := c.newFunc()
+		if err := json.Unmarshal(e.Content, v); err != nil {
+			return nil, withErrorKind(errKindDecode, fmt.Errorf("decode %s %d: %w", c.table, e.ID, err))
+		}
+		result = append(result, CacheValue[T]{Found: true, Data: v})
+	}
+	return result, nil
+}
+
+func (c *entityCache[T]) newItem(pipe memproxy.Pipeline) *Item[T, EntityCacheKey] {
+	filler := item.NewMultiGetFiller[CacheValue[T], EntityCacheKey](c.load, func(v CacheValue[T]) EntityCacheKey {
+		return c.key(v.Data.GetId())
+	})
+	return NewCacheItem[T, EntityCacheKey](pipe, c.newFunc, c.format, filler)
+}
+
+// getAll gets the distinct ids in the pipeline, the not found ids are missing from the result
+func (c *entityCache[T]) getAll(ctx context.Context, it *Item[T, EntityCacheKey], ids []int64) func() (map[int64]T, error) {
+	fnList := mapSlice(ids, func(id int64) func() (CacheValue[T], error) {
+		return it.Get(ctx, c.key(id))
+	})
+	return func() (map[int64]T, error) {
+		result := make(map[int64]T, len(ids))
+		for i, fn := range fnList {
+			v, err := fn()
+			if err != nil {
+				return nil, withErrorKind(errKindMemcached, err)
+			}
+			if v.Found {
+				result[ids[i]] = v.Data
+			}
+		}
+		return result, nil
+	}
+}
+
+func (c *entityCache[T]) upsert(ctx context.Context, entities []T) error {
+	if len(entities) == 0 {
+		return nil
+	}
+
+	contents := make([]entityContent, 0, len(entities))
+	for _, e := range entities {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		contents = append(contents, entityContent{ID: e.GetId(), Content: data})
+	}
+
+	return c.repo.store.UpsertEntities(ctx, c.table, contents)
+}
+
+// deleteKeys deletes the keys of the entities in every format
+func (c *entityCache[T]) deleteKeys(pipe memproxy.Pipeline, ids []int64) []func() (memproxy.DeleteResponse, error) {
+	var fnList []func() (memproxy.DeleteResponse, error)
+	for _, id := range ids {
+		for _, format := range valueFormatNames() {
+			key := c.key(id)
+			key.Format = format
+			fnList = append(fnList, pipe.Delete(key.String(), memproxy.DeleteOptions{}))
+		}
+	}
+	return fnList
+}
+
+// productEntities returns the distinct brands and attributes referenced by the products
+func productEntities(products []*pb.Product) ([]*pb.Brand, []*pb.Attribute) {
+	var brands []*pb.Brand
+	var attributes []*pb.Attribute
+	brandSet := map[int64]struct{}{}
+	attributeSet := map[int64]struct{}{}
+
+	for _, p := range products {
+		if p == nil {
+			continue
+		}
+		if p.Brand != nil {
+			if _, existed := brandSet[p.Brand.Id]; !existed {
+				brandSet[p.Brand.Id] = struct{}{}
+				brands = append(brands, p.Brand)
+			}
+		}
+		for _, a := range p.Attributes {
+			if _, existed := attributeSet[a.Id]; !existed {
+				attributeSet[a.Id] = struct{}{}
+				attributes = append(attributes, a)
+			}
+		}
+	}
+	return brands, attributes
+}
+
+func brandIDs(brands []*pb.Brand) []int64 {
+	return mapSlice(brands, (*pb.Brand).GetId)
+}
+
+func attributeIDs(attributes []*pb.Attribute) []int64 {
+	return mapSlice(attributes, (*pb.Attribute).GetId)
+}
+
+// upsertProductEntities writes the brands and the attributes embedded in the products to their own tables
+func (r *CacheRepo) upsertProductEntities(ctx context.Context, products []*pb.Product) error {
+	brands, attributes := productEntities(products)
+	if err := r.brands.upsert(ctx, brands); err != nil {
+		return err
+	}
+	return r.attributes.upsert(ctx, attributes)
+}
+
+// assembleProduct replaces the references of the slim product by the cached entities,
+// references of not found entities are kept. The entities are shared between the products
+func assembleProduct(slim *pb.Product, brands map[int64]*pb.Brand, attributes map[int64]*pb.Attribute) *pb.Product {
+	p := *slim
+	if p.Brand != nil {
+		if b, ok := brands[p.Brand.Id]; ok {
+			p.Brand = b
+		}
+	}
+	p.Attributes = mapSlice(slim.Attributes, func(a *pb.Attribute) *pb.Attribute {
+		if full, ok := attributes[a.Id]; ok {
+			return full
+		}
+		return a
+	})
+	return &p
+}
+
+// getNormalizedProducts gets the slim products then the distinct brands and attributes they reference,
+// the entity gets of all the products are batched in the same pipeline
+func (r *CacheRepo) getNormalizedProducts(
+	ctx context.Context, pipe memproxy.Pipeline, slimProducts []*pb.Product,
+) ([]*pb.Product, BatchStats, error) {
+	brands, attributes := productEntities(slimProducts)
+
+	brandItem := r.brands.newItem(pipe)
+	attributeItem := r.attributes.newItem(pipe)
+
+	brandsFn := r.brands.getAll(ctx, brandItem, brandIDs(brands))
+	attributesFn := r.attributes.getAll(ctx, attributeItem, attributeIDs(attributes))
+
+	brandMap, err := brandsFn()
+	if err != nil {
+		return nil, BatchStats{}, err
+	}
+	attributeMap, err := attributesFn()
+	if err != nil {
+		return nil, BatchStats{}, err
+	}
+
+	result := mapSlice(slimProducts, func(p *pb.Product) *pb.Product {
+		if p == nil {
+			return nil
+		}
+		return assembleProduct(p, brandMap, attributeMap)
+	})
+
+	brandStats := brandItem.GetStats()
+	attributeStats := attributeItem.GetStats()
+	stats := BatchStats{
+		EntityGetCount:  uint64(len(brands) + len(attributes)),
+		EntityMissCount: brandStats.FillCount + attributeStats.FillCount,
+		TotalBytes:      brandStats.TotalBytesRecv + attributeStats.TotalBytesRecv,
+	}
+	stats.addDecodeStats(brandItem.GetDecodeStats())
+	stats.addDecodeStats(attributeItem.GetDecodeStats())
+	return result, stats, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"bench-multiget/pb"
+)
+
+func TestSlimProduct_Assemble(t *testing.T) {
+	p := newProduct(0)
+
+	brands, attributes := productEntities([]*pb.Product{p, nil, newProduct(0)})
+	if len(brands) != 1 || len(attributes) != 1 {
+		t.Fatalf("expected distinct entities, got %d brands, %d attributes", len(brands), len(attributes))
+	}
+
+	slim := slimProduct(p)
+	if slim.Brand.Name != "" || slim.Attributes[0].Name != "" || len(slim.Attributes) != len(p.Attributes) {
+		t.Fatalf("unexpected slim product: %v", slim)
+	}
+
+	brandMap := map[int64]*pb.Brand{brands[0].Id: brands[0]}
+	attributeMap := map[int64]*pb.Attribute{attributes[0].Id: attributes[0]}
+	if result := assembleProduct(slim, brandMap, attributeMap); !reflect.DeepEqual(result, p) {
+		t.Errorf("assembled product differs from the original: %v", result)
+	}
+
+	// references of not found entities are kept
+	result := assembleProduct(slim, nil, nil)
+	if result.Brand.Id != p.Brand.Id || result.Attributes[0].Id != p.Attributes[0].Id {
+		t.Errorf("unexpected product: %v", result)
+	}
+}
+
+func TestEntityCacheKey_String(t *testing.T) {
+	repo := NewCacheRepo(nil, nil, WithKeyPrefix("bench", "3"), WithNormalizedModel())
+	if s := repo.brands.key(12).String(); s != "bench/v3/b/12" {
+		t.Errorf("unexpected brand key: %s", s)
+	}
+	if s := repo.productKey("SKU01").String(); s != "bench/v3/ps/SKU01" {
+		t.Errorf("unexpected product key: %s", s)
+	}
+
+	repo = NewCacheRepo(nil, nil, WithCompression(zstdCompressor{}))
+	if s := repo.attributes.key(5).String(); s != "a:gogo+zstd/5" {
+		t.Errorf("unexpected attribute key: %s", s)
+	}
+}
+
+func TestCacheRepo_NormalizedModel(t *testing.T) {
+	repo := newCacheRepoTest(t, WithNormalizedModel())
+	ctx := context.Background()
+
+	p := newProduct(0)
+	p.Sku = "TEST-NORMALIZED"
+	if err := repo.UpsertProducts(ctx, []*pb.Product{p}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, hit := range []bool{false, true} {
+		products, stats, err := repo.GetProducts(ctx, []string{p.Sku})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(products[0], p) {
+			t.Errorf("unexpected product: %v", products[0])
+		}
+		if stats.EntityGetCount != 2 || (stats.EntityMissCount == 0) != hit || (stats.HitCount == 1) != hit {
+			t.Errorf("unexpected stats of read %d: %+v", i, stats)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	outputText      = "text"
+	outputJSON      = "json"
+	outputCSV       = "csv"
+	outputBenchstat = "benchstat"
+)
+
+type outputConfig struct {
+	Format string
+	File   string
+}
+
+func (c *outputConfig) registerFlags(fs *flag.FlagSet) {
+	c.Format = outputText
+	fs.StringVar(&c.Format, "output", c.Format, "result format: text, json (one object per line), csv, benchstat")
+	fs.StringVar(&c.File, "output-file", c.File, "append results to this file instead of stdout")
+}
+
+func (c *outputConfig) validate() error {
+	switch c.Format {
+	case outputText:
+		if c.File != "" {
+			return errors.New("output-file requires a machine-readable output format")
+		}
+	case outputJSON, outputCSV, outputBenchstat:
+	default:
+		return fmt.Errorf("unknown output format '%s', must be one of: text, json, csv, benchstat", c.Format)
+	}
+	return nil
+}
+
+// runEnv is the environment a benchmark runs in, captured at the end of the run
+type runEnv struct {
+	GitCommit       string
+	GoVersion       string
+	GOGC            string
+	GOMemLimit      string
+	MemproxyVersion string
+}
+
+var (
+	buildInfoOnce        sync.Once
+	buildGitCommit       string
+	buildMemproxyVersion string
+)
+
+func readBuildInfo() (string, string) {
+	buildInfoOnce.Do(func() {
+		buildGitCommit, buildMemproxyVersion = doReadBuildInfo()
+	})
+	return buildGitCommit, buildMemproxyVersion
+}
+
+func doReadBuildInfo() (string, string) {
+	var commit, memproxyVersion string
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				commit = s.Value
+			}
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/QuangTung97/memproxy" {
+				memproxyVersion = dep.Version
+			}
+		}
+	}
+
+	if commit == "" {
+		// binaries built by 'go run' or 'go test' are not stamped with vcs info
+		out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+		if err == nil {
+			commit = strings.TrimSpace(string(out))
+		}
+	}
+	return commit, memproxyVersion
+}
+
+func currentGCSettings() (string, string) {
+	percent := debug.SetGCPercent(-1)
+	debug.SetGCPercent(percent)
+
+	gogc := strconv.Itoa(percent)
+	if percent < 0 {
+		gogc = "off"
+	}
+
+	limit := debug.SetMemoryLimit(-1)
+	memLimit := strconv.FormatInt(limit, 10)
+	if limit == math.MaxInt64 {
+		memLimit = "off"
+	}
+	return gogc, memLimit
+}
+
+func currentRunEnv() runEnv {
+	commit, memproxyVersion := readBuildInfo()
+	gogc, memLimit := currentGCSettings()
+	return runEnv{
+		GitCommit:       commit,
+		GoVersion:       runtime.Version(),
+		GOGC:            gogc,
+		GOMemLimit:      memLimit,
+		MemproxyVersion: memproxyVersion,
+	}
+}
+
+// resultRecord is the flat, machine-readable form of a benchResult, latencies are in microseconds
+type resultRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+
+	Backend      string  `json:"backend"`
+	Products     int     `json:"products"`
+	Threads      int     `json:"threads"`
+	Batch        int     `json:"batch"`
+	Loops        int     `json:"loops"`
+	Conns        int     `json:"conns"`
+	Topology     string  `json:"topology"`
+	Model        string  `json:"model"`
+	ESMethod     string  `json:"es_method"`
+	ESProjection string  `json:"es_projection"`
+	ESDecoder    string  `json:"es_decoder"`
+	Servers      int     `json:"servers"`
+	Rate         float64 `json:"rate"`
+	Dist         string  `json:"dist"`
+	Codec        string  `json:"codec"`
+	Compression  string  `json:"compression"`
+	L1           string  `json:"l1"`
+	WriteRatio   float64 `json:"write_ratio"`
+	Duration     string  `json:"duration"`
+	Warmup       string  `json:"warmup"`
+
+	GitCommit       string `json:"git_commit"`
+	GoVersion       string `json:"go_version"`
+	GOGC            string `json:"gogc"`
+	GOMemLimit      string `json:"gomemlimit"`
+	MemproxyVersion string `json:"memproxy_version"`
+
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	TotalKeys      uint64  `json:"total_keys"`
+	TotalBatches   uint64  `json:"total_batches"`
+	GetsPerSecond  float64 `json:"gets_per_second"`
+	TotalBytes     uint64  `json:"total_bytes"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	L1HitCount     uint64  `json:"l1_hits"`
+	HitCount       uint64  `json:"hits"`
+	MissCount      uint64  `json:"misses"`
+	NotFound       uint64  `json:"not_found"`
+	NegativeHits   uint64  `json:"negative_hits"`
+	StaleServes    uint64  `json:"stale_serves"`
+	Refreshes      uint64  `json:"refreshes"`
+	EntityGets     uint64  `json:"entity_gets"`
+	EntityMisses   uint64  `json:"entity_misses"`
+
+	BytesPerObject        float64 `json:"bytes_per_object"`
+	CompressionRatio      float64 `json:"compression_ratio"`
+	DecodeNsPerObject     float64 `json:"decode_ns_per_object"`
+	DecompressNsPerObject float64 `json:"decompress_ns_per_object"`
+
+	LatencyMean float64 `json:"latency_mean_us"`
+	LatencyP50  float64 `json:"latency_p50_us"`
+	LatencyP90  float64 `json:"latency_p90_us"`
+	LatencyP99  float64 `json:"latency_p99_us"`
+	LatencyP999 float64 `json:"latency_p999_us"`
+	LatencyMax  float64 `json:"latency_max_us"`
+
+	Writes          uint64  `json:"writes"`
+	WritesPerSecond float64 `json:"writes_per_second"`
+	StaleReads      uint64  `json:"stale_reads"`
+	WriteLatencyP99 float64 `json:"write_latency_p99_us"`
+
+	ErrorCount   uint64            `json:"errors"`
+	ErrorRate    float64           `json:"error_rate"`
+	ErrorsByKind map[string]uint64 `json:"errors_by_kind,omitempty"`
+
+	// ServerGets and ServerBytesRecv are keyed by the memcached server address
+	ServerGets      map[string]uint64 `json:"server_gets,omitempty"`
+	ServerBytesRecv map[string]uint64 `json:"server_bytes_recv,omitempty"`
+}
+
+// recordCache returns a setting only used by the cache backend
+func recordCache(backend string, v string) string {
+	if backend != backendCache {
+		return ""
+	}
+	return v
+}
+
+// recordElastic returns a setting only used by the elasticsearch backend
+func recordElastic(backend string, v string) string {
+	if backend != backendElastic {
+		return ""
+	}
+	return v
+}
+
+func toMicros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+func formatConfigDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func newResultRecord(r benchResult) resultRecord {
+	conf := r.Config
+	return resultRecord{
+		Timestamp: r.Timestamp,
+
+		Backend:      r.Backend,
+		Products:     conf.NumProducts,
+		Threads:      conf.NumThreads,
+		Batch:        conf.NumSkusPerBatch,
+		Loops:        conf.NumLoops,
+		Conns:        conf.MemcachedConns,
+		Topology:     recordCache(r.Backend, conf.Topology),
+		Model:        recordCache(r.Backend, conf.Model),
+		ESMethod:     recordElastic(r.Backend, conf.ESMethod),
+		ESProjection: recordElastic(r.Backend, conf.ESProjection),
+		ESDecoder:    recordElastic(r.Backend, conf.ESDecoder),
+		Servers:      len(r.Servers),
+		Rate:         conf.Rate,
+		Dist:         conf.Keys.Distribution,
+		Codec:        recordCache(r.Backend, conf.Codec),
+		Compression:  recordCache(r.Backend, conf.Compression),
+		L1:           recordCache(r.Backend, conf.L1Policy),
+		WriteRatio:   conf.WriteRatio,
+		Duration:     formatConfigDuration(conf.Duration),
+		Warmup:       formatConfigDuration(conf.Warmup),
+
+		GitCommit:       r.Env.GitCommit,
+		GoVersion:       r.Env.GoVersion,
+		GOGC:            r.Env.GOGC,
+		GOMemLimit:      r.Env.GOMemLimit,
+		MemproxyVersion: r.Env.MemproxyVersion,
+
+		ElapsedSeconds: r.Duration.Seconds(),
+		TotalKeys:      r.TotalKeys,
+		TotalBatches:   r.Latency.Count(),
+		GetsPerSecond:  r.getsPerSecond(),
+		TotalBytes:     r.TotalBytes,
+		BytesPerSecond: r.bytesPerSecond(),
+		L1HitCount:     r.L1HitCount,
+		HitCount:       r.HitCount,
+		MissCount:      r.MissCount,
+		NotFound:       r.NotFoundCount,
+		NegativeHits:   r.NegativeHitCount,
+		StaleServes:    r.StaleServeCount,
+		Refreshes:      r.RefreshCount,
+		EntityGets:     r.EntityGetCount,
+		EntityMisses:   r.EntityMissCount,
+
+		BytesPerObject:        r.bytesPerObject(),
+		CompressionRatio:      r.compressionRatio(),
+		DecodeNsPerObject:     float64(r.decodeTimePerObject()),
+		DecompressNsPerObject: float64(r.decompressTimePerObject()),
+
+		LatencyMean: toMicros(r.Latency.Mean()),
+		LatencyP50:  toMicros(r.Latency.ValueAtQuantile(0.5)),
+		LatencyP90:  toMicros(r.Latency.ValueAtQuantile(0.9)),
+		LatencyP99:  toMicros(r.Latency.ValueAtQuantile(0.99)),
+		LatencyP999: toMicros(r.Latency.ValueAtQuantile(0.999)),
+		LatencyMax:  toMicros(r.Latency.Max()),
+
+		Writes:          r.WriteCount,
+		WritesPerSecond: float64(r.WriteCount) / r.Duration.Seconds(),
+		StaleReads:      r.StaleReadCount,
+		WriteLatencyP99: toMicros(r.WriteLatency.ValueAtQuantile(0.99)),
+
+		ErrorCount:   r.errorCount(),
+		ErrorRate:    r.errorRate(),
+		ErrorsByKind: errorsByKind(r.Errors),
+
+		ServerGets: serverCounts(r.Servers, func(s serverResult) uint64 {
+			return s.Gets
+		}),
+		ServerBytesRecv: serverCounts(r.Servers, func(s serverResult) uint64 {
+			return s.BytesRecv
+		}),
+	}
+}
+
+func serverCounts(servers []serverResult, fn func(s serverResult) uint64) map[string]uint64 {
+	if len(servers) == 0 {
+		return nil
+	}
+	result := make(map[string]uint64, len(servers))
+	for _, s := range servers {
+		result[s.Addr] = fn(s)
+	}
+	return result
+}
+
+func errorsByKind(c *errorCounter) map[string]uint64 {
+	if c == nil || len(c.counts) == 0 {
+		return nil
+	}
+	result := make(map[string]uint64, len(c.counts))
+	for kind, count := range c.counts {
+		result[kind] = count
+	}
+	return result
+}
+
+// formatCounts formats the counts as name=count pairs separated by semicolons, sorted by name
+func formatCounts(m map[string]uint64) string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := mapSlice(names, func(name string) string {
+		return fmt.Sprintf("%s=%d", name, m[name])
+	})
+	return strings.Join(pairs, ";")
+}
+
+// csvFields returns the json names and the values of every field of the record, in declaration order
+func (rec resultRecord) csvFields() ([]string, []string) {
+	v := reflect.ValueOf(rec)
+	t := v.Type()
+
+	names := make([]string, 0, t.NumField())
+	values := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		names = append(names, t.Field(i).Tag.Get("json"))
+
+		switch f := v.Field(i).Interface().(type) {
+		case time.Time:
+			values = append(values, f.Format(time.RFC3339))
+		case float64:
+			values = append(values, strconv.FormatFloat(f, 'f', -1, 64))
+		case map[string]uint64:
+			values = append(values, formatCounts(f))
+		default:
+			values = append(values, fmt.Sprint(f))
+		}
+	}
+	return names, values
+}
+
+// benchstatName uses the key=value sub-benchmark naming, so benchstat can group and filter by the parameters
+func (rec resultRecord) benchstatName() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "BenchmarkMultiGet/backend=%s/threads=%d/batch=%d", rec.Backend, rec.Threads, rec.Batch)
+	if rec.Backend == backendCache {
+		fmt.Fprintf(&b, "/conns=%d/topology=%s/model=%s/codec=%s/compression=%s/l1=%s",
+			rec.Conns, rec.Topology, rec.Model, rec.Codec, rec.Compression, rec.L1)
+	}
+	if rec.Backend == backendElastic {
+		fmt.Fprintf(&b, "/method=%s/projection=%s/decoder=%s", rec.ESMethod, rec.ESProjection, rec.ESDecoder)
+	}
+	fmt.Fprintf(&b, "/dist=%s", rec.Dist)
+	if rec.Rate > 0 {
+		fmt.Fprintf(&b, "/rate=%g", rec.Rate)
+	}
+	if rec.WriteRatio > 0 {
+		fmt.Fprintf(&b, "/write_ratio=%g", rec.WriteRatio)
+	}
+	fmt.Fprintf(&b, "/gogc=%s", rec.GOGC)
+	return b.String()
+}
+
+// resultWriter writes the machine-readable results, the text format is printed directly by the commands
+type resultWriter struct {
+	format string
+	out    io.Writer
+	closer io.Closer
+
+	wroteHeader bool
+}
+
+func newResultWriter(conf outputConfig) (*resultWriter, error) {
+	w := &resultWriter{
+		format: conf.Format,
+		out:    os.Stdout,
+	}
+
+	if conf.File != "" {
+		f, err := os.OpenFile(conf.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+
+		w.out = f
+		w.closer = f
+		// do not repeat the csv header when appending
+		w.wroteHeader = info.Size() > 0
+	}
+	return w, nil
+}
+
+func (w *resultWriter) Write(r benchResult) error {
+	rec := newResultRecord(r)
+
+	switch w.format {
+	case outputJSON:
+		return json.NewEncoder(w.out).Encode(rec)
+
+	case outputCSV:
+		names, values := rec.csvFields()
+		cw := csv.NewWriter(w.out)
+		if !w.wroteHeader {
+			w.wroteHeader = true
+			if err := cw.Write(names); err != nil {
+				return err
+			}
+		}
+		if err := cw.Write(values); err != nil {
+			return err
+		}
+		cw.Flush()
+		return cw.Error()
+
+	default:
+		return w.writeBenchstat(rec)
+	}
+}
+
+func (w *resultWriter) writeBenchstat(rec resultRecord) error {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		_, err := fmt.Fprintf(w.out, "goos: %s\ngoarch: %s\npkg: bench-multiget\n", runtime.GOOS, runtime.GOARCH)
+		if err != nil {
+			return err
+		}
+	}
+
+	nsPerOp := 0.0
+	if rec.TotalBatches > 0 {
+		nsPerOp = rec.ElapsedSeconds * 1e9 / float64(rec.TotalBatches)
+	}
+
+	_, err := fmt.Fprintf(w.out,
+		"%s-%d\t%d\t%.0f ns/op\t%.2f gets/s\t%.2f MB/s\t%.0f p50-us\t%.0f p99-us\t%.0f p999-us\n",
+		rec.benchstatName(), runtime.GOMAXPROCS(0), rec.TotalBatches, nsPerOp,
+		rec.GetsPerSecond, rec.BytesPerSecond/1024/1024,
+		rec.LatencyP50, rec.LatencyP99, rec.LatencyP999,
+	)
+	return err
+}
+
+func (w *resultWriter) Close() error {
+	if w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
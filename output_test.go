@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newOutputTestResult(t *testing.T) benchResult {
+	conf := defaultBenchConfig()
+	conf.NumProducts = 100
+	conf.NumThreads = 2
+	conf.NumSkusPerBatch = 10
+	conf.NumLoops = 20
+	return mustRunMultiGet(t, &fakeBackend{}, backendCache, conf)
+}
+
+func writeTestResults(t *testing.T, format string, file string, results ...benchResult) {
+	t.Helper()
+
+	w, err := newResultWriter(outputConfig{Format: format, File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if err := w.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResultWriter_JSON(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "results.jsonl")
+	writeTestResults(t, outputJSON, file, newOutputTestResult(t), newOutputTestResult(t))
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var records []resultRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec resultRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	rec := records[0]
+	if rec.Backend != backendCache || rec.Threads != 2 || rec.Batch != 10 {
+		t.Errorf("unexpected params: %+v", rec)
+	}
+	if rec.TotalKeys != 2*20*10 || rec.TotalBatches != 2*20 || rec.GetsPerSecond <= 0 {
+		t.Errorf("unexpected throughput: %+v", rec)
+	}
+	if rec.GoVersion == "" || rec.GOGC == "" {
+		t.Errorf("missing environment: %+v", rec)
+	}
+}
+
+func TestResultWriter_CSV_AppendWithoutRepeatedHeader(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "results.csv")
+	writeTestResults(t, outputCSV, file, newOutputTestResult(t))
+	writeTestResults(t, outputCSV, file, newOutputTestResult(t))
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected header and 2 rows, got %d rows", len(rows))
+	}
+	if rows[0][0] != "timestamp" || rows[0][1] != "backend" {
+		t.Errorf("unexpected header: %v", rows[0])
+	}
+	if rows[1][1] != backendCache || rows[2][1] != backendCache {
+		t.Errorf("unexpected rows: %v", rows[1:])
+	}
+}
+
+func TestResultWriter_Benchstat(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "results.txt")
+	writeTestResults(t, outputBenchstat, file, newOutputTestResult(t))
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 3 header lines and 1 result, got: %q", lines)
+	}
+	if !strings.HasPrefix(lines[0], "goos: ") {
+		t.Errorf("unexpected header: %s", lines[0])
+	}
+
+	fields := strings.Split(lines[3], "\t")
+	if !strings.HasPrefix(fields[0], "BenchmarkMultiGet/backend=cache/threads=2/batch=10/conns=4/topology=replicated/model=denormalized/codec=gogo/compression=none/l1=none/dist=sequential/gogc=") {
+		t.Errorf("unexpected benchmark name: %s", fields[0])
+	}
+	if fields[1] != "40" || !strings.HasSuffix(fields[2], " ns/op") {
+		t.Errorf("unexpected benchmark line: %s", lines[3])
+	}
+}
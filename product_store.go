@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+
+	"bench-multiget/pb"
+)
+
+// productStore is the database behind the cache, with the products and their brands and attributes rows
+type productStore interface {
+	GetProducts(ctx context.Context, skus []string) ([]ProductContent, error)
+	InsertProducts(ctx context.Context, contents []ProductContent) error
+	UpsertProducts(ctx context.Context, contents []ProductContent) error
+	UpdateProducts(ctx context.Context, products []*pb.Product) error
+	DeleteProducts(ctx context.Context, skus []string) error
+
+	GetEntities(ctx context.Context, table string, ids []int64) ([]entityContent, error)
+	UpsertEntities(ctx context.Context, table string, contents []entityContent) error
+}
+
+type mysqlStore struct {
+	db *sqlx.DB
+}
+
+var _ productStore = &mysqlStore{}
+
+func (s *mysqlStore) GetProducts(ctx context.Context, skus []string) ([]ProductContent, error) {
+	query := `
+SELECT sku, content FROM products WHERE sku IN (?)
+`
+	query, args, err := sqlx.In(query, skus)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []ProductContent
+	err = s.db.SelectContext(ctx, &result, query, args...)
+	if err != nil {
+		return nil, withErrorKind(errKindMySQL, err)
+	}
+	return result, nil
+}
+
+func (s *mysqlStore) InsertProducts(ctx context.Context, contents []ProductContent) error {
+	query := `
+INSERT INTO products (sku, content)
+VALUES (:sku, :content)
+`
+	_, err := s.db.NamedExecContext(ctx, query, contents)
+	if err != nil {
+		return withErrorKind(errKindMySQL, err)
+	}
+	return nil
+}
+
+func (s *mysqlStore) UpsertProducts(ctx context.Context, contents []ProductContent) error {
+	query := `
+INSERT INTO products (sku, content)
+VALUES (:sku, :content)
+ON DUPLICATE KEY UPDATE content = VALUES(content)
+`
+	_, err := s.db.NamedExecContext(ctx, query, contents)
+	if err != nil {
+		return withErrorKind(errKindMySQL, err)
+	}
+	return nil
+}
+
+func (s *mysqlStore) UpdateProducts(ctx context.Context, products []*pb.Product) error {
+	return updateProductContents(ctx, s.db, products)
+}
+
+func (s *mysqlStore) DeleteProducts(ctx context.Context, skus []string) error {
+	return deleteProductRows(ctx, s.db, skus)
+}
+
+// deleteProductRows also records the deletes in product_deletes for the incremental elasticsearch sync
+func deleteProductRows(ctx context.Context, db *sqlx.DB, skus []string) error {
+	query, args, err := sqlx.In(`DELETE FROM products WHERE sku IN (?)`, skus)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return withErrorKind(errKindMySQL, err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return withErrorKind(errKindMySQL, err)
+	}
+
+	deletes := mapSlice(skus, func(sku string) productDelete {
+		return productDelete{Sku: sku}
+	})
+	_, err = tx.NamedExecContext(ctx, `
+INSERT INTO product_deletes (sku)
+VALUES (:sku)
+ON DUPLICATE KEY UPDATE deleted_at = CURRENT_TIMESTAMP
+`, deletes)
+	if err != nil {
+		return withErrorKind(errKindMySQL, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return withErrorKind(errKindMySQL, err)
+	}
+	return nil
+}
+
+func updateProductContents(ctx context.Context, db *sqlx.DB, products []*pb.Product) error {
+	query := `
+UPDATE products SET content = ? WHERE sku = ?
+`
+	for _, p := range products {
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, query, data, p.Sku)
+		if err != nil {
+			return withErrorKind(errKindMySQL, err)
+		}
+	}
+	return nil
+}
+
+func (s *mysqlStore) GetEntities(ctx context.Context, table string, ids []int64) ([]entityContent, error) {
+	query, args, err := sqlx.In(fmt.Sprintf(`SELECT id, content FROM %s WHERE id IN (?)`, table), ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var contents []entityContent
+	if err := s.db.SelectContext(ctx, &contents, query, args...); err != nil {
+		return nil, withErrorKind(errKindMySQL, err)
+	}
+	return contents, nil
+}
+
+func (s *mysqlStore) UpsertEntities(ctx context.Context, table string, contents []entityContent) error {
+	query := fmt.Sprintf(`
+INSERT INTO %s (id, content)
+VALUES (:id, :content)
+ON DUPLICATE KEY UPDATE content = VALUES(content)
+`, table)
+	if _, err := s.db.NamedExecContext(ctx, query, contents); err != nil {
+		return withErrorKind(errKindMySQL, err)
+	}
+	return nil
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/QuangTung97/memproxy"
 	"github.com/QuangTung97/memproxy/item"
@@ -12,49 +16,274 @@ type ProtoMessage interface {
 	Unmarshal(data []byte) error
 }
 
+// ValueFormat is the codec and the compression of the cached values
+type ValueFormat[T ProtoMessage] struct {
+	Codec       Codec[T]
+	Compression Compressor
+}
+
+func defaultValueFormat[T ProtoMessage]() ValueFormat[T] {
+	return ValueFormat[T]{
+		Codec:       gogoCodec[T]{},
+		Compression: noCompressor{},
+	}
+}
+
+// Name is empty for the default format, otherwise it is the codec name followed by the compression name
+func (f ValueFormat[T]) Name() string {
+	if f.Codec.ID() == codecIDGogo && f.Compression.ID() == compressionIDNone {
+		return ""
+	}
+	return f.Codec.Name() + "+" + f.Compression.Name()
+}
+
+// valueFormatNames returns the names of all the formats, the writes delete the keys of every format,
+// so the readers configured with another format sharing the cluster never read a stale value
+func valueFormatNames() []string {
+	var names []string
+	for _, codec := range codecNames {
+		for _, compression := range compressionNames {
+			if codec == codecGogo && compression == compressionNone {
+				names = append(names, "")
+				continue
+			}
+			names = append(names, codec+"+"+compression)
+		}
+	}
+	return names
+}
+
+// A tombstone is the single byte zero.
+// Other values start with the id of the codec and the id of the compression,
+// followed by the soft expiry in unix milliseconds as an uvarint (zero means never stale) and the payload
+const valueKindNotFound byte = 0
+
+// valueLayoutVersion is the version of the layout above, it is part of the auto key version.
+// Increment it on any change of the layout, so the values with the old layout are not read
+const valueLayoutVersion byte = 1
+
+// CacheValue is a cached entity, or a tombstone when Found is false
 type CacheValue[T ProtoMessage] struct {
-	Data T
+	Found bool
+	Data  T
+
+	// FreshUntil is the soft expiry, after it the value is still served but should be refreshed.
+	// Zero means never stale, it is always zero for tombstones
+	FreshUntil time.Time
+
+	// format is set by the item before the value is stored, the default format is used when empty
+	format ValueFormat[T]
+}
+
+func (p CacheValue[T]) isStale(now time.Time) bool {
+	return !p.FreshUntil.IsZero() && !now.Before(p.FreshUntil)
 }
 
 func (p CacheValue[T]) Marshal() ([]byte, error) {
-	return p.Data.Marshal()
+	if !p.Found {
+		return []byte{valueKindNotFound}, nil
+	}
+
+	format := p.format
+	if format.Codec == nil {
+		format = defaultValueFormat[T]()
+	}
+
+	data, err := format.Codec.Marshal(p.Data)
+	if err != nil {
+		return nil, err
+	}
+	data, err = format.Compression.Compress(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var freshUntil uint64
+	if !p.FreshUntil.IsZero() {
+		freshUntil = uint64(p.FreshUntil.UnixMilli())
+	}
+
+	result := make([]byte, 0, 2+binary.MaxVarintLen64+len(data))
+	result = append(result, format.Codec.ID(), format.Compression.ID())
+	result = binary.AppendUvarint(result, freshUntil)
+	return append(result, data...), nil
 }
 
-func unmarshalCacheValue[T ProtoMessage](newFunc func() T) func(data []byte) (CacheValue[T], error) {
-	return func(data []byte) (CacheValue[T], error) {
-		v := CacheValue[T]{
-			Data: newFunc(),
-		}
-		err := v.Data.Unmarshal(data)
-		return v, err
+func isTombstone(data []byte) bool {
+	return len(data) > 0 && data[0] == valueKindNotFound
+}
+
+var errInvalidCacheValue = errors.New("invalid cache value")
+
+// DecodeStats is the number, the size and the time of the entities decoded from the cache,
+// RawBytes is the size after decompression
+type DecodeStats struct {
+	Count    uint64
+	Bytes    uint64
+	RawBytes uint64
+
+	Duration           time.Duration
+	DecompressDuration time.Duration
+}
+
+// decodeCacheValue decodes a value with the codec and the compression it was stored with,
+// the stats are not changed for tombstones
+func decodeCacheValue[T ProtoMessage](newFunc func() T, data []byte, stats *DecodeStats) (CacheValue[T], error) {
+	if len(data) == 0 {
+		return CacheValue[T]{}, errInvalidCacheValue
+	}
+	if data[0] == valueKindNotFound {
+		return CacheValue[T]{}, nil
+	}
+	if len(data) < 2 {
+		return CacheValue[T]{}, errInvalidCacheValue
+	}
+
+	start := time.Now()
+
+	codec, err := codecByID[T](data[0])
+	if err != nil {
+		return CacheValue[T]{}, fmt.Errorf("%w: %v", errInvalidCacheValue, err)
+	}
+	compression, err := compressorByID(data[1])
+	if err != nil {
+		return CacheValue[T]{}, fmt.Errorf("%w: %v", errInvalidCacheValue, err)
+	}
+
+	freshUntil, n := binary.Uvarint(data[2:])
+	if n <= 0 {
+		return CacheValue[T]{}, errInvalidCacheValue
+	}
+
+	payload, err := compression.Decompress(data[2+n:])
+	if err != nil {
+		return CacheValue[T]{}, err
+	}
+	decompressed := time.Now()
+
+	v := CacheValue[T]{
+		Found: true,
+		Data:  newFunc(),
+		format: ValueFormat[T]{
+			Codec:       codec,
+			Compression: compression,
+		},
+	}
+	if freshUntil > 0 {
+		v.FreshUntil = time.UnixMilli(int64(freshUntil))
+	}
+	if err := codec.Unmarshal(payload, v.Data); err != nil {
+		return CacheValue[T]{}, err
+	}
+
+	stats.Count++
+	stats.Bytes += uint64(len(data))
+	stats.RawBytes += uint64(len(payload))
+	stats.DecompressDuration += decompressed.Sub(start)
+	stats.Duration += time.Since(start)
+	return v, nil
+}
+
+// ttlPipeline sets the TTL of the stored values, tombstones have their own TTL
+type ttlPipeline struct {
+	memproxy.Pipeline
+	ttl         uint32
+	negativeTTL uint32
+}
+
+func (p *ttlPipeline) LeaseSet(
+	key string, data []byte, cas uint64, options memproxy.LeaseSetOptions,
+) func() (memproxy.LeaseSetResponse, error) {
+	if isTombstone(data) {
+		options.TTL = p.negativeTTL
+	} else {
+		options.TTL = p.ttl
+	}
+	return p.Pipeline.LeaseSet(key, data, cas, options)
+}
+
+func ttlSeconds(d time.Duration) uint32 {
+	return uint32((d + time.Second - 1) / time.Second)
+}
+
+// withTTL sets the memcached TTL of found values and of tombstones, zero means no expiry
+func withTTL(pipe memproxy.Pipeline, ttl time.Duration, negativeTTL time.Duration) memproxy.Pipeline {
+	if ttl <= 0 && negativeTTL <= 0 {
+		return pipe
+	}
+	return &ttlPipeline{
+		Pipeline:    pipe,
+		ttl:         ttlSeconds(ttl),
+		negativeTTL: ttlSeconds(negativeTTL),
+	}
+}
+
+type cacheItemOptions struct {
+	softTTL time.Duration
+}
+
+// CacheItemOption configures the item created by NewCacheItem
+type CacheItemOption func(opts *cacheItemOptions)
+
+// WithItemSoftTTL sets the soft expiry of the filled values, zero means never stale
+func WithItemSoftTTL(ttl time.Duration) CacheItemOption {
+	return func(opts *cacheItemOptions) {
+		opts.softTTL = ttl
 	}
 }
 
 type Item[T ProtoMessage, K item.Key] struct {
 	item.Item[CacheValue[T], K]
+
+	negativeHits uint64
+	decodeStats  DecodeStats
 }
 
+// NewCacheItem creates an item storing the values in the format,
+// keys missing in the filler results are cached as tombstones
 func NewCacheItem[T ProtoMessage, K item.Key](
-	pipe memproxy.Pipeline, newFunc func() T,
-	filler func(ctx context.Context, key K) func() (T, error),
+	pipe memproxy.Pipeline, newFunc func() T, format ValueFormat[T],
+	filler item.Filler[CacheValue[T], K],
+	options ...CacheItemOption,
 ) *Item[T, K] {
+	var opts cacheItemOptions
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	result := &Item[T, K]{}
+
 	it := item.New[CacheValue[T], K](
 		pipe,
-		unmarshalCacheValue[T](newFunc),
+		func(data []byte) (CacheValue[T], error) {
+			v, err := decodeCacheValue(newFunc, data, &result.decodeStats)
+			if err == nil && !v.Found {
+				result.negativeHits++
+			}
+			return v, err
+		},
 		func(ctx context.Context, key K) func() (CacheValue[T], error) {
 			fn := filler(ctx, key)
 			return func() (CacheValue[T], error) {
-				resp, err := fn()
-				if err != nil {
-					return CacheValue[T]{}, err
+				v, err := fn()
+				v.format = format
+				if v.Found && opts.softTTL > 0 {
+					v.FreshUntil = time.Now().Add(opts.softTTL)
 				}
-				return CacheValue[T]{
-					Data: resp,
-				}, nil
+				return v, err
 			}
 		},
 	)
-	return &Item[T, K]{
-		Item: *it,
-	}
+	result.Item = *it
+	return result
+}
+
+// NegativeHitCount returns the number of tombstones got from the cache
+func (i *Item[T, K]) NegativeHitCount() uint64 {
+	return i.negativeHits
+}
+
+// GetDecodeStats returns the stats of the entities got from the cache, tombstones are not included
+func (i *Item[T, K]) GetDecodeStats() DecodeStats {
+	return i.decodeStats
 }
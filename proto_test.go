@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/QuangTung97/memproxy"
+	"github.com/QuangTung97/memproxy/fake"
+	"github.com/QuangTung97/memproxy/item"
+
+	"bench-multiget/pb"
+)
+
+type productLoader struct {
+	products map[string]*pb.Product
+	calls    int
+}
+
+func (l *productLoader) load(_ context.Context, keys []ProductCacheKey) ([]ProductCacheValue, error) {
+	l.calls++
+	var result []ProductCacheValue
+	for _, k := range keys {
+		if p, ok := l.products[k.Sku]; ok {
+			result = append(result, ProductCacheValue{Found: true, Data: p})
+		}
+	}
+	return result, nil
+}
+
+func getCachedProducts(
+	pipe memproxy.Pipeline, loader *productLoader, skus []string, options ...CacheItemOption,
+) ([]ProductCacheValue, uint64) {
+	filler := item.NewMultiGetFiller[ProductCacheValue, ProductCacheKey](loader.load,
+		func(v ProductCacheValue) ProductCacheKey {
+			return getProductKey(v.Data)
+		},
+	)
+	it := NewCacheItem[*pb.Product, ProductCacheKey](
+		pipe, newProductProto, defaultValueFormat[*pb.Product](), filler, options...,
+	)
+
+	fnList := mapSlice(skus, func(sku string) func() (ProductCacheValue, error) {
+		return it.Get(context.Background(), ProductCacheKey{Sku: sku})
+	})
+	return mapSlice(fnList, func(fn func() (ProductCacheValue, error)) ProductCacheValue {
+		v, err := fn()
+		if err != nil {
+			panic(err)
+		}
+		return v
+	}), it.NegativeHitCount()
+}
+
+func TestCacheItem_NegativeCaching(t *testing.T) {
+	mc := fake.New()
+	loader := &productLoader{
+		products: map[string]*pb.Product{"SKU01": {Sku: "SKU01", Name: "Product 1"}},
+	}
+
+	skus := []string{"SKU01", "SKU02"}
+
+	values, negativeHits := getCachedProducts(mc.Pipeline(context.Background()), loader, skus)
+	if !values[0].Found || values[0].Data.Name != "Product 1" {
+		t.Errorf("unexpected value: %+v", values[0])
+	}
+	if values[1].Found || values[1].Data != nil {
+		t.Errorf("expected not found: %+v", values[1])
+	}
+	if negativeHits != 0 || loader.calls != 1 {
+		t.Errorf("unexpected negative hits: %d, loader calls: %d", negativeHits, loader.calls)
+	}
+
+	values, negativeHits = getCachedProducts(mc.Pipeline(context.Background()), loader, skus)
+	if !values[0].Found || values[1].Found {
+		t.Errorf("unexpected values: %+v", values)
+	}
+	if negativeHits != 1 || loader.calls != 1 {
+		t.Errorf("tombstone must be served from cache, negative hits: %d, loader calls: %d", negativeHits, loader.calls)
+	}
+}
+
+type recordingPipeline struct {
+	memproxy.Pipeline
+	ttls map[string]uint32
+}
+
+func (p *recordingPipeline) LeaseSet(
+	key string, data []byte, cas uint64, options memproxy.LeaseSetOptions,
+) func() (memproxy.LeaseSetResponse, error) {
+	p.ttls[key] = options.TTL
+	return p.Pipeline.LeaseSet(key, data, cas, options)
+}
+
+func TestTTLPipeline(t *testing.T) {
+	recorder := &recordingPipeline{
+		Pipeline: fake.New().Pipeline(context.Background()),
+		ttls:     map[string]uint32{},
+	}
+	loader := &productLoader{
+		products: map[string]*pb.Product{"SKU01": {Sku: "SKU01"}},
+	}
+
+	getCachedProducts(withTTL(recorder, 90*time.Second, 1500*time.Millisecond), loader, []string{"SKU01", "SKU02"})
+
+	if recorder.ttls["p/SKU01"] != 90 {
+		t.Errorf("unexpected found value ttl: %d", recorder.ttls["p/SKU01"])
+	}
+	if recorder.ttls["p/SKU02"] != 2 {
+		t.Errorf("unexpected tombstone ttl: %d", recorder.ttls["p/SKU02"])
+	}
+}
+
+func TestCacheItem_SoftTTL(t *testing.T) {
+	mc := fake.New()
+	loader := &productLoader{
+		products: map[string]*pb.Product{"SKU01": {Sku: "SKU01", Name: "Product 1"}},
+	}
+	skus := []string{"SKU01", "SKU02"}
+
+	start := time.Now()
+	getCachedProducts(mc.Pipeline(context.Background()), loader, skus, WithItemSoftTTL(time.Minute))
+
+	values, _ := getCachedProducts(mc.Pipeline(context.Background()), loader, skus, WithItemSoftTTL(time.Minute))
+	if loader.calls != 1 || values[0].Data.Name != "Product 1" {
+		t.Fatalf("unexpected values: %+v, loader calls: %d", values, loader.calls)
+	}
+
+	freshUntil := values[0].FreshUntil
+	if freshUntil.Before(start.Add(time.Minute).Truncate(time.Millisecond)) || freshUntil.After(time.Now().Add(time.Minute)) {
+		t.Errorf("unexpected soft expiry: %v", freshUntil)
+	}
+	if values[0].isStale(start) || !values[0].isStale(freshUntil) {
+		t.Errorf("unexpected stale state: %v", freshUntil)
+	}
+	if !values[1].FreshUntil.IsZero() || values[1].isStale(freshUntil) {
+		t.Errorf("tombstones must never be stale: %+v", values[1])
+	}
+}
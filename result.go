@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type benchResult struct {
+	Backend string
+	Config  benchConfig
+
+	Timestamp time.Time
+	Env       runEnv
+
+	Duration   time.Duration
+	TotalKeys  uint64
+	L1HitCount uint64
+	HitCount   uint64
+	MissCount  uint64
+	TotalBytes uint64
+
+	NotFoundCount    uint64
+	NegativeHitCount uint64
+
+	StaleServeCount uint64
+	RefreshCount    uint64
+
+	EntityGetCount  uint64
+	EntityMissCount uint64
+
+	DecodeCount    uint64
+	DecodeBytes    uint64
+	DecodeRawBytes uint64
+	DecodeTime     time.Duration
+	DecompressTime time.Duration
+
+	// Latency is the histogram of the duration of every multi get batch call
+	Latency *Histogram
+
+	// WriteCount, StaleReadCount and WriteLatency are only set for the mixed read / write workload
+	WriteCount     uint64
+	StaleReadCount uint64
+	WriteLatency   *Histogram
+
+	// Errors counts the failed operations of the measured phase per error kind
+	Errors *errorCounter
+
+	// Servers is only set for the cache backend
+	Servers []serverResult
+}
+
+func (r benchResult) getsPerSecond() float64 {
+	return float64(r.TotalKeys) / r.Duration.Seconds()
+}
+
+// scheduledKeysPerSecond is the rate of the keys of the operations issued by the open loop,
+// a write takes the slot of a whole batch
+func (r benchResult) scheduledKeysPerSecond() float64 {
+	keys := r.TotalKeys + r.WriteCount*uint64(r.Config.NumSkusPerBatch)
+	return float64(keys) / r.Duration.Seconds()
+}
+
+// rateSustained reports whether the open loop run achieved at least 99% of the target rate
+func (r benchResult) rateSustained() bool {
+	return r.scheduledKeysPerSecond() >= 0.99*r.Config.Rate
+}
+
+func ratio(count uint64, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total)
+}
+
+// bytesPerObject is the average encoded size of the values decoded from the cache,
+// or the size of the search responses per hit for elasticsearch
+func (r benchResult) bytesPerObject() float64 {
+	if r.DecodeCount == 0 {
+		return 0
+	}
+	return float64(r.DecodeBytes) / float64(r.DecodeCount)
+}
+
+// compressionRatio is the size before compression divided by the size in the cache
+func (r benchResult) compressionRatio() float64 {
+	if r.DecodeBytes == 0 {
+		return 0
+	}
+	return float64(r.DecodeRawBytes) / float64(r.DecodeBytes)
+}
+
+func (r benchResult) decodeTimePerObject() time.Duration {
+	if r.DecodeCount == 0 {
+		return 0
+	}
+	return r.DecodeTime / time.Duration(r.DecodeCount)
+}
+
+func (r benchResult) decompressTimePerObject() time.Duration {
+	if r.DecodeCount == 0 {
+		return 0
+	}
+	return r.DecompressTime / time.Duration(r.DecodeCount)
+}
+
+func (r benchResult) errorCount() uint64 {
+	if r.Errors == nil {
+		return 0
+	}
+	return r.Errors.total()
+}
+
+// errorRate is the fraction of failed operations, both multi gets and writes
+func (r benchResult) errorRate() float64 {
+	errCount := r.errorCount()
+	total := errCount + r.WriteCount
+	if r.Latency != nil {
+		total += r.Latency.Count()
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(errCount) / float64(total)
+}
+
+func (r benchResult) bytesPerSecond() float64 {
+	return float64(r.TotalBytes) / r.Duration.Seconds()
+}
+
+func (r benchResult) print() {
+	if r.Backend == backendCache {
+		fmt.Println("MEMCACHED CONNS:", r.Config.MemcachedConns)
+		fmt.Println("TOPOLOGY:", r.Config.Topology)
+		fmt.Println("MODEL:", r.Config.Model)
+		fmt.Println("KEY PREFIX:", cacheKeyPrefix(r.Config.KeyNamespace, productSchemaVersion(r.Config.KeyVersion)))
+		fmt.Println("CODEC:", r.Config.Codec)
+		fmt.Println("COMPRESSION:", r.Config.Compression)
+	}
+	if r.Backend == backendElastic {
+		fmt.Println("ES METHOD:", r.Config.ESMethod)
+		fmt.Println("ES PROJECTION:", r.Config.ESProjection)
+		fmt.Println("ES DECODER:", r.Config.ESDecoder)
+	}
+	if r.Config.Warmup > 0 {
+		fmt.Println("WARMUP:", r.Config.Warmup)
+	}
+	if r.Config.Cooldown > 0 {
+		fmt.Println("COOLDOWN:", r.Config.Cooldown)
+	}
+	fmt.Println("TOTAL TIME:", r.Duration)
+	fmt.Println("BATCH SIZE:", r.Config.NumSkusPerBatch)
+	fmt.Println("TOTAL THREADS:", r.Config.NumThreads)
+	fmt.Println("KEY DISTRIBUTION:", r.Config.Keys.Distribution)
+	fmt.Println("TOTAL KEYS:", r.TotalKeys)
+	fmt.Println("TOTAL MISSES:", r.MissCount)
+	if r.Config.L1Policy != l1PolicyNone && r.Backend == backendCache {
+		fmt.Println("L1 POLICY:", r.Config.L1Policy)
+		fmt.Println("TOTAL L1 HITS:", r.L1HitCount)
+		fmt.Println("L1 HIT RATIO:", ratio(r.L1HitCount, r.TotalKeys))
+	}
+	fmt.Println("TOTAL HITS:", r.HitCount)
+	if r.NotFoundCount > 0 {
+		fmt.Println("TOTAL NOT FOUND:", r.NotFoundCount)
+		fmt.Println("TOTAL NEGATIVE HITS:", r.NegativeHitCount)
+	}
+	if r.Config.Model == modelNormalized && r.Backend == backendCache {
+		fmt.Println("TOTAL ENTITY GETS:", r.EntityGetCount)
+		fmt.Println("TOTAL ENTITY MISSES:", r.EntityMissCount)
+	}
+	if r.Config.SoftTTL > 0 && r.Backend == backendCache {
+		fmt.Println("SOFT TTL:", r.Config.SoftTTL)
+		fmt.Println("TOTAL STALE SERVES:", r.StaleServeCount)
+		fmt.Println("STALE SERVE RATIO:", ratio(r.StaleServeCount, r.TotalKeys))
+		fmt.Println("TOTAL REFRESHES:", r.RefreshCount)
+	}
+	fmt.Println("GETS per Second:", r.getsPerSecond())
+	if r.Config.Rate > 0 {
+		fmt.Println("TARGET GETS per Second:", r.Config.Rate)
+		fmt.Println("RATE SUSTAINED:", r.rateSustained())
+	}
+
+	fmt.Println("TOTAL BYTES:", r.TotalBytes)
+	fmt.Println("MB per second:", r.bytesPerSecond()/1024/1024)
+	fmt.Println("Mb per second:", r.bytesPerSecond()*8/1024/1024)
+
+	if r.DecodeCount > 0 {
+		fmt.Println("BYTES per Object:", r.bytesPerObject())
+		if r.Config.Compression != compressionNone {
+			fmt.Println("COMPRESSION RATIO:", r.compressionRatio())
+			fmt.Println("DECOMPRESS TIME per Object:", r.decompressTimePerObject())
+		}
+		fmt.Println("DECODE TIME per Object:", r.decodeTimePerObject())
+		fmt.Println("TOTAL DECODE TIME:", r.DecodeTime)
+	}
+
+	if r.Latency != nil {
+		fmt.Println("TOTAL BATCHES:", r.Latency.Count())
+		printLatency("BATCH", r.Latency)
+	}
+
+	fmt.Println("TOTAL ERRORS:", r.errorCount())
+	fmt.Printf("ERROR RATE: %.4f%%\n", r.errorRate()*100)
+	if r.Errors != nil {
+		for _, kind := range r.Errors.kinds() {
+			fmt.Printf("ERRORS %s: %d (%s)\n", strings.ToUpper(kind), r.Errors.counts[kind], r.Errors.samples[kind])
+		}
+	}
+
+	r.printServers()
+
+	if r.Config.WriteRatio > 0 {
+		fmt.Println("WRITE RATIO:", r.Config.WriteRatio)
+		fmt.Println("TOTAL WRITES:", r.WriteCount)
+		fmt.Println("WRITES per Second:", float64(r.WriteCount)/r.Duration.Seconds())
+		fmt.Println("TOTAL STALE READS:", r.StaleReadCount)
+		printLatency("WRITE", r.WriteLatency)
+	}
+}
+
+// printServers prints the share of the requests and the bytes of every memcached server
+func (r benchResult) printServers() {
+	var totalGets, totalBytes uint64
+	for _, s := range r.Servers {
+		totalGets += s.Gets
+		totalBytes += s.BytesRecv
+	}
+	for _, s := range r.Servers {
+		fmt.Printf("SERVER %s: GETS %d (%.1f%%) SETS %d DELETES %d MB RECV %.2f (%.1f%%) MB SENT %.2f MEM MB %.2f\n",
+			s.Addr, s.Gets, ratio(s.Gets, totalGets)*100, s.Sets, s.Deletes,
+			float64(s.BytesRecv)/1024/1024, ratio(s.BytesRecv, totalBytes)*100,
+			float64(s.BytesSent)/1024/1024, s.MemUsage/1024/1024,
+		)
+	}
+}
+
+func printLatency(name string, h *Histogram) {
+	fmt.Printf("%s LATENCY MEAN: %v\n", name, h.Mean())
+	for _, p := range reportedPercentiles {
+		fmt.Printf("%s LATENCY %s: %v\n", name, strings.ToUpper(p.name), h.ValueAtQuantile(p.quantile))
+	}
+	fmt.Printf("%s LATENCY MAX: %v\n", name, h.Max())
+}
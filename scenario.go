@@ -0,0 +1,484 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jmoiron/sqlx"
+)
+
+// scenarioFile describes a benchmark matrix, every combination of the matrix values is run sequentially.
+// Example:
+//
+//	dsn = "root:1@tcp(localhost:3306)/bench?parseTime=true"
+//	memcached = "localhost:11211"
+//	duration = "30s"
+//	warmup = "5s"
+//
+//	[matrix]
+//	backend = ["cache"]
+//	threads = [8, 10, 20]
+//	batch = [20, 40]
+//	conns = [4, 8]
+//	topology = ["replicated", "hash"]
+//	model = ["denormalized", "normalized"]
+//	es_method = ["search", "mget", "mget-realtime"]
+//	es_projection = ["source", "excludes:attributes", "stored:sku"]
+//	es_decoder = ["jsoniter", "stream"]
+//	codec = ["gogo", "msgpack"]
+//	compression = ["none", "zstd"]
+//	l1 = ["none", "lru", "tinylfu"]
+//	rate = [0, 50000] # zero means closed loop
+//	dist = ["sequential", "zipf"]
+//	write_ratio = [0, 0.05]
+//	gogc = ["off"]
+//	gomemlimit = ["512MiB"]
+type scenarioFile struct {
+	Name string `toml:"name"`
+
+	DSN              string `toml:"dsn"`
+	MemcachedServers string `toml:"memcached"`
+	ESAddr           string `toml:"es"`
+	NumProducts      int    `toml:"products"`
+
+	// Duration, Warmup and Cooldown are the same for every cell, so results are comparable
+	Duration time.Duration `toml:"duration"`
+	Warmup   time.Duration `toml:"warmup"`
+	Cooldown time.Duration `toml:"cooldown"`
+
+	TTL         time.Duration `toml:"ttl"`
+	SoftTTL     time.Duration `toml:"soft_ttl"`
+	NegativeTTL time.Duration `toml:"negative_ttl"`
+	L1Size      int           `toml:"l1_size"`
+	L1TTL       time.Duration `toml:"l1_ttl"`
+
+	ZipfS    float64 `toml:"zipf_s"`
+	HotKeys  float64 `toml:"hot_keys"`
+	HotRatio float64 `toml:"hot_ratio"`
+
+	Matrix scenarioMatrix `toml:"matrix"`
+}
+
+type scenarioMatrix struct {
+	Backends        []string  `toml:"backend"`
+	NumThreads      []int     `toml:"threads"`
+	NumSkusPerBatch []int     `toml:"batch"`
+	NumLoops        []int     `toml:"loops"`
+	MemcachedConns  []int     `toml:"conns"`
+	Topologies      []string  `toml:"topology"`
+	Models          []string  `toml:"model"`
+	ESMethods       []string  `toml:"es_method"`
+	ESProjections   []string  `toml:"es_projection"`
+	ESDecoders      []string  `toml:"es_decoder"`
+	Codecs          []string  `toml:"codec"`
+	Compressions    []string  `toml:"compression"`
+	L1Policies      []string  `toml:"l1"`
+	Rates           []float64 `toml:"rate"`
+	Distributions   []string  `toml:"dist"`
+	WriteRatios     []float64 `toml:"write_ratio"`
+	GOGC            []string  `toml:"gogc"`
+	GOMemLimit      []string  `toml:"gomemlimit"`
+}
+
+type scenarioCell struct {
+	Backend string
+	Config  benchConfig
+
+	GOGC       string
+	GOMemLimit string
+}
+
+func loadScenarioFile(path string) (*scenarioFile, error) {
+	var s scenarioFile
+	meta, err := toml.DecodeFile(path, &s)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown scenario keys: %v", undecoded)
+	}
+	return &s, nil
+}
+
+func valuesOrDefault[T any](values []T, defaultValue T) []T {
+	if len(values) == 0 {
+		return []T{defaultValue}
+	}
+	return values
+}
+
+// matrixAxis is the list of values of a single matrix dimension, each value is applied to a copy of a cell
+type matrixAxis []func(cell *scenarioCell)
+
+func newMatrixAxis[T any](values []T, defaultValue T, set func(cell *scenarioCell, v T)) matrixAxis {
+	return mapSlice(valuesOrDefault(values, defaultValue), func(v T) func(cell *scenarioCell) {
+		return func(cell *scenarioCell) {
+			set(cell, v)
+		}
+	})
+}
+
+// expandMatrix computes the cartesian product of the axes, the first axis varies the slowest
+func expandMatrix(base scenarioCell, axes []matrixAxis) []scenarioCell {
+	cells := []scenarioCell{base}
+	for _, axis := range axes {
+		next := make([]scenarioCell, 0, len(cells)*len(axis))
+		for _, cell := range cells {
+			for _, set := range axis {
+				newCell := cell
+				set(&newCell)
+				next = append(next, newCell)
+			}
+		}
+		cells = next
+	}
+	return cells
+}
+
+func (s *scenarioFile) baseConfig(backend string) (benchConfig, error) {
+	conf, err := defaultBackendConfig(backend)
+	if err != nil {
+		return benchConfig{}, err
+	}
+
+	if s.DSN != "" {
+		conf.DSN = s.DSN
+	}
+	if s.MemcachedServers != "" {
+		conf.MemcachedServers = s.MemcachedServers
+	}
+	if s.ESAddr != "" {
+		conf.ESAddr = s.ESAddr
+	}
+	if s.NumProducts > 0 {
+		conf.NumProducts = s.NumProducts
+	}
+
+	conf.Duration = s.Duration
+	conf.Warmup = s.Warmup
+	conf.Cooldown = s.Cooldown
+
+	if s.TTL > 0 {
+		conf.TTL = s.TTL
+	}
+	if s.SoftTTL > 0 {
+		conf.SoftTTL = s.SoftTTL
+	}
+	if s.NegativeTTL > 0 {
+		conf.NegativeTTL = s.NegativeTTL
+	}
+	if s.L1Size > 0 {
+		conf.L1Size = s.L1Size
+	}
+	if s.L1TTL > 0 {
+		conf.L1TTL = s.L1TTL
+	}
+	if s.ZipfS > 0 {
+		conf.Keys.ZipfS = s.ZipfS
+	}
+	if s.HotKeys > 0 {
+		conf.Keys.HotKeys = s.HotKeys
+	}
+	if s.HotRatio > 0 {
+		conf.Keys.HotRatio = s.HotRatio
+	}
+	return conf, nil
+}
+
+func (s *scenarioFile) cells() ([]scenarioCell, error) {
+	m := s.Matrix
+
+	var result []scenarioCell
+	for _, backend := range valuesOrDefault(m.Backends, backendCache) {
+		conf, err := s.baseConfig(backend)
+		if err != nil {
+			return nil, err
+		}
+
+		connsList := valuesOrDefault(m.MemcachedConns, conf.MemcachedConns)
+		topologies := valuesOrDefault(m.Topologies, conf.Topology)
+		models := valuesOrDefault(m.Models, conf.Model)
+		esMethods := valuesOrDefault(m.ESMethods, conf.ESMethod)
+		esProjections := valuesOrDefault(m.ESProjections, conf.ESProjection)
+		esDecoders := valuesOrDefault(m.ESDecoders, conf.ESDecoder)
+		codecs := valuesOrDefault(m.Codecs, conf.Codec)
+		compressions := valuesOrDefault(m.Compressions, conf.Compression)
+		l1Policies := valuesOrDefault(m.L1Policies, conf.L1Policy)
+		if backend != backendCache {
+			// number of memcached connections, topologies, models, codecs, compressions and l1 policies
+			// have no effect on other backends
+			connsList = connsList[:1]
+			topologies = topologies[:1]
+			models = models[:1]
+			codecs = codecs[:1]
+			compressions = compressions[:1]
+			l1Policies = l1Policies[:1]
+		}
+		if backend != backendElastic {
+			esMethods = esMethods[:1]
+			esProjections = esProjections[:1]
+			esDecoders = esDecoders[:1]
+		}
+
+		cells := expandMatrix(scenarioCell{Backend: backend, Config: conf}, []matrixAxis{
+			newMatrixAxis(m.NumThreads, conf.NumThreads, func(c *scenarioCell, v int) {
+				c.Config.NumThreads = v
+			}),
+			newMatrixAxis(m.NumSkusPerBatch, conf.NumSkusPerBatch, func(c *scenarioCell, v int) {
+				c.Config.NumSkusPerBatch = v
+			}),
+			newMatrixAxis(m.NumLoops, conf.NumLoops, func(c *scenarioCell, v int) {
+				c.Config.NumLoops = v
+			}),
+			newMatrixAxis(connsList, conf.MemcachedConns, func(c *scenarioCell, v int) {
+				c.Config.MemcachedConns = v
+			}),
+			newMatrixAxis(topologies, conf.Topology, func(c *scenarioCell, v string) {
+				c.Config.Topology = v
+			}),
+			newMatrixAxis(models, conf.Model, func(c *scenarioCell, v string) {
+				c.Config.Model = v
+			}),
+			newMatrixAxis(esMethods, conf.ESMethod, func(c *scenarioCell, v string) {
+				c.Config.ESMethod = v
+			}),
+			newMatrixAxis(esProjections, conf.ESProjection, func(c *scenarioCell, v string) {
+				c.Config.ESProjection = v
+			}),
+			newMatrixAxis(esDecoders, conf.ESDecoder, func(c *scenarioCell, v string) {
+				c.Config.ESDecoder = v
+			}),
+			newMatrixAxis(codecs, conf.Codec, func(c *scenarioCell, v string) {
+				c.Config.Codec = v
+			}),
+			newMatrixAxis(compressions, conf.Compression, func(c *scenarioCell, v string) {
+				c.Config.Compression = v
+			}),
+			newMatrixAxis(l1Policies, conf.L1Policy, func(c *scenarioCell, v string) {
+				c.Config.L1Policy = v
+			}),
+			newMatrixAxis(m.Rates, 0, func(c *scenarioCell, v float64) {
+				c.Config.Rate = v
+			}),
+			newMatrixAxis(m.Distributions, conf.Keys.Distribution, func(c *scenarioCell, v string) {
+				c.Config.Keys.Distribution = v
+			}),
+			newMatrixAxis(m.WriteRatios, 0, func(c *scenarioCell, v float64) {
+				c.Config.WriteRatio = v
+			}),
+			newMatrixAxis(m.GOGC, "", func(c *scenarioCell, v string) {
+				c.GOGC = v
+			}),
+			newMatrixAxis(m.GOMemLimit, "", func(c *scenarioCell, v string) {
+				c.GOMemLimit = v
+			}),
+		})
+
+		for _, cell := range cells {
+			if err := cell.Config.validate(); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, cells...)
+	}
+	return result, nil
+}
+
+func parseGOGC(s string) (int, error) {
+	if s == "off" {
+		return -1, nil
+	}
+	return strconv.Atoi(s)
+}
+
+var memLimitUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{suffix: "TiB", size: 1 << 40},
+	{suffix: "GiB", size: 1 << 30},
+	{suffix: "MiB", size: 1 << 20},
+	{suffix: "KiB", size: 1 << 10},
+	{suffix: "B", size: 1},
+}
+
+// parseMemLimit parses the same format as the GOMEMLIMIT environment variable
+func parseMemLimit(s string) (int64, error) {
+	if s == "off" {
+		return math.MaxInt64, nil
+	}
+
+	for _, unit := range memLimitUnits {
+		if !strings.HasSuffix(s, unit.suffix) {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(s, unit.suffix), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid memory limit '%s': %w", s, err)
+		}
+		return n * unit.size, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// applyGCSettings overrides the GOGC and GOMEMLIMIT settings, empty values keep the current settings.
+// The returned function restores the previous settings.
+func applyGCSettings(gogc string, memLimit string) (func(), error) {
+	prevPercent := debug.SetGCPercent(-1)
+	debug.SetGCPercent(prevPercent)
+	prevLimit := debug.SetMemoryLimit(-1)
+
+	restore := func() {
+		debug.SetGCPercent(prevPercent)
+		debug.SetMemoryLimit(prevLimit)
+	}
+
+	if gogc != "" {
+		percent, err := parseGOGC(gogc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gogc '%s': %w", gogc, err)
+		}
+		debug.SetGCPercent(percent)
+	}
+
+	if memLimit != "" {
+		limit, err := parseMemLimit(memLimit)
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		debug.SetMemoryLimit(limit)
+	}
+
+	return restore, nil
+}
+
+func printScenarioHeader() {
+	fmt.Printf("%-8s %8s %6s %8s %6s %14s %10s %10s %6s %10s %14s %10s %14s %10s %10s %10s %10s %10s\n",
+		"BACKEND", "THREADS", "BATCH", "LOOPS", "CONNS", "CODEC/L1", "RATE", "DIST", "GOGC", "MEMLIMIT",
+		"TIME", "KEYS", "GETS/s", "MB/s", "MISSES", "P50", "P99", "MAX",
+	)
+}
+
+func orDefault(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func roundLatency(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
+
+func formatRate(conf benchConfig, r benchResult) string {
+	if conf.Rate <= 0 {
+		return "-"
+	}
+	if !r.rateSustained() {
+		return fmt.Sprintf("%.0f!", conf.Rate)
+	}
+	return fmt.Sprintf("%.0f", conf.Rate)
+}
+
+// formatCellCodec returns the codec, the compression, the l1 policy, the normalized model
+// and the sharded topology of the cache backend, or the method, the projection and the decoder
+// of the elasticsearch backend
+func formatCellCodec(cell scenarioCell) string {
+	if cell.Backend == backendElastic {
+		result := cell.Config.ESMethod + "/" + cell.Config.ESDecoder
+		if cell.Config.ESProjection != esProjectionSource {
+			result += "+" + cell.Config.ESProjection
+		}
+		return result
+	}
+	if cell.Backend != backendCache {
+		return "-"
+	}
+	result := cell.Config.Codec + "/" + cell.Config.Compression
+	if cell.Config.L1Policy != l1PolicyNone {
+		result += "+" + cell.Config.L1Policy
+	}
+	if cell.Config.Model == modelNormalized {
+		result += "+norm"
+	}
+	if cell.Config.Topology == topologyHash {
+		result += "@" + topologyHash
+	}
+	return result
+}
+
+func printScenarioRow(cell scenarioCell, r benchResult) {
+	fmt.Printf("%-8s %8d %6d %8d %6d %14s %10s %10s %6s %10s %14s %10d %14.2f %10.2f %10d %10s %10s %10s\n",
+		cell.Backend, cell.Config.NumThreads, cell.Config.NumSkusPerBatch, cell.Config.NumLoops,
+		cell.Config.MemcachedConns, formatCellCodec(cell),
+		formatRate(cell.Config, r), cell.Config.Keys.Distribution,
+		orDefault(cell.GOGC), orDefault(cell.GOMemLimit),
+		r.Duration.Round(time.Millisecond), r.TotalKeys, r.getsPerSecond(), r.bytesPerSecond()/1024/1024,
+		r.MissCount, roundLatency(r.Latency.ValueAtQuantile(0.5)), roundLatency(r.Latency.ValueAtQuantile(0.99)),
+		roundLatency(r.Latency.Max()),
+	)
+}
+
+func runScenarioCell(db *sqlx.DB, cell scenarioCell) (benchResult, error) {
+	restore, err := applyGCSettings(cell.GOGC, cell.GOMemLimit)
+	if err != nil {
+		return benchResult{}, err
+	}
+	defer restore()
+
+	runtime.GC()
+	return runBackendBench(db, cell.Backend, cell.Config)
+}
+
+func runScenario(s *scenarioFile, out outputConfig, history historyConfig) error {
+	cells, err := s.cells()
+	if err != nil {
+		return err
+	}
+	if len(cells) == 0 {
+		return errors.New("empty scenario matrix")
+	}
+
+	var w *resultWriter
+	if out.Format == outputText {
+		if s.Name != "" {
+			fmt.Println("SCENARIO:", s.Name)
+		}
+		fmt.Println("TOTAL CELLS:", len(cells))
+		printScenarioHeader()
+	} else {
+		w, err = newResultWriter(out)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = w.Close() }()
+	}
+
+	db := sqlx.MustConnect("mysql", cells[0].Config.DSN)
+	for _, cell := range cells {
+		r, err := runScenarioCell(db, cell)
+		if err != nil {
+			return err
+		}
+		if err := history.save(r); err != nil {
+			return err
+		}
+
+		if w == nil {
+			printScenarioRow(cell, r)
+			continue
+		}
+		if err := w.Write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
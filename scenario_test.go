@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestScenarioFile_Cells(t *testing.T) {
+	s, err := loadScenarioFile("scenarios/memcached.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cells, err := s.cells()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 3*2*2 {
+		t.Fatalf("expected 12 cells, got %d", len(cells))
+	}
+
+	first := cells[0]
+	if first.Backend != backendCache || first.Config.NumThreads != 8 ||
+		first.Config.NumSkusPerBatch != 20 || first.Config.MemcachedConns != 4 {
+		t.Errorf("unexpected first cell: %+v", first)
+	}
+	if first.GOGC != "off" || first.GOMemLimit != "512MiB" {
+		t.Errorf("unexpected gc settings: %+v", first)
+	}
+
+	last := cells[len(cells)-1]
+	if last.Config.NumThreads != 20 || last.Config.NumSkusPerBatch != 40 || last.Config.MemcachedConns != 8 {
+		t.Errorf("unexpected last cell: %+v", last)
+	}
+}
+
+func TestScenarioFile_Cells_ElasticIgnoresConns(t *testing.T) {
+	s := &scenarioFile{
+		Matrix: scenarioMatrix{
+			Backends:       []string{backendElastic},
+			NumThreads:     []int{10, 20},
+			MemcachedConns: []int{4, 8},
+		},
+	}
+
+	cells, err := s.cells()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 2 {
+		t.Fatalf("expected 2 cells, got %d", len(cells))
+	}
+	if cells[0].Config.NumSkusPerBatch != 20 {
+		t.Errorf("expected elastic default batch size, got %d", cells[0].Config.NumSkusPerBatch)
+	}
+}
+
+func TestParseMemLimit(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{input: "512MiB", expected: 512 << 20},
+		{input: "2GiB", expected: 2 << 30},
+		{input: "1024", expected: 1024},
+		{input: "100B", expected: 100},
+	}
+	for _, tc := range tests {
+		n, err := parseMemLimit(tc.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tc.expected {
+			t.Errorf("parseMemLimit(%s) = %d, expected %d", tc.input, n, tc.expected)
+		}
+	}
+
+	_, err := parseMemLimit("12XB")
+	if err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/QuangTung97/go-memcache/memcache"
+	"github.com/QuangTung97/memproxy"
+	"github.com/QuangTung97/memproxy/proxy"
+)
+
+const (
+	// topologyReplicated stores every key in every server, reads go to a single server per pipeline
+	topologyReplicated = "replicated"
+
+	// topologyHash shards the keys between the servers by consistent hashing
+	topologyHash = "hash"
+)
+
+var topologyNames = []string{topologyReplicated, topologyHash}
+
+func validateTopology(name string) error {
+	for _, n := range topologyNames {
+		if n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown topology '%s', must be one of: %s", name, strings.Join(topologyNames, ", "))
+}
+
+// hashRingReplicas is the number of points of each server on the ring
+const hashRingReplicas = 160
+
+type ringPoint struct {
+	hash   uint64
+	server proxy.ServerID
+}
+
+// hashRoute is a consistent hashing route, keys of a failed server go to the next server on the ring
+type hashRoute struct {
+	servers []proxy.ServerID
+	stats   proxy.ServerStats
+	ring    []ringPoint
+}
+
+var _ proxy.Route = &hashRoute{}
+
+// mixHash is the splitmix64 finalizer, FNV alone spreads similar short keys poorly on the ring
+func mixHash(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+func hashRingKey(key string) uint64 {
+	return mixHash(hashKey(key))
+}
+
+func newHashRoute(servers []proxy.ServerID, stats proxy.ServerStats) *hashRoute {
+	ring := make([]ringPoint, 0, len(servers)*hashRingReplicas)
+	for _, server := range servers {
+		for i := 0; i < hashRingReplicas; i++ {
+			ring = append(ring, ringPoint{
+				hash:   hashRingKey(fmt.Sprintf("%d-%d", server, i)),
+				server: server,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+
+	return &hashRoute{
+		servers: servers,
+		stats:   stats,
+		ring:    ring,
+	}
+}
+
+// NewSelector ...
+func (r *hashRoute) NewSelector() proxy.Selector {
+	return &hashSelector{route: r}
+}
+
+// AllServerIDs ...
+func (r *hashRoute) AllServerIDs() []proxy.ServerID {
+	return r.servers
+}
+
+// ringIndex returns the index of the first point at or after the hash of the key
+func (r *hashRoute) ringIndex(key string) int {
+	h := hashRingKey(key)
+	index := sort.Search(len(r.ring), func(i int) bool {
+		return r.ring[i].hash >= h
+	})
+	if index == len(r.ring) {
+		return 0
+	}
+	return index
+}
+
+type hashSelector struct {
+	route  *hashRoute
+	failed map[proxy.ServerID]struct{}
+}
+
+func (s *hashSelector) isFailed(server proxy.ServerID) bool {
+	if _, existed := s.failed[server]; existed {
+		return true
+	}
+	return s.route.stats.IsServerFailed(server)
+}
+
+// SetFailedServer ...
+func (s *hashSelector) SetFailedServer(server proxy.ServerID) {
+	if s.failed == nil {
+		s.failed = map[proxy.ServerID]struct{}{}
+	}
+	if _, existed := s.failed[server]; !existed {
+		s.failed[server] = struct{}{}
+		s.route.stats.NotifyServerFailed(server)
+	}
+}
+
+// HasNextAvailableServer ...
+func (s *hashSelector) HasNextAvailableServer() bool {
+	return len(s.failed) < len(s.route.servers)
+}
+
+// SelectServer returns the owner of the key, or the next not failed server on the ring
+func (s *hashSelector) SelectServer(key string) proxy.ServerID {
+	ring := s.route.ring
+	index := s.route.ringIndex(key)
+	for i := 0; i < len(ring); i++ {
+		p := ring[(index+i)%len(ring)]
+		if !s.isFailed(p.server) {
+			return p.server
+		}
+	}
+	return ring[index].server
+}
+
+// SelectForDelete also deletes from the owner of the key when it is failed,
+// so it does not serve the old value after recovering
+func (s *hashSelector) SelectForDelete(key string) []proxy.ServerID {
+	owner := s.route.ring[s.route.ringIndex(key)].server
+	selected := s.SelectServer(key)
+	if selected == owner {
+		return []proxy.ServerID{owner}
+	}
+	return []proxy.ServerID{owner, selected}
+}
+
+// Reset ...
+func (s *hashSelector) Reset() {
+}
+
+// serverCounters counts the requests and the bytes of a memcached server
+type serverCounters struct {
+	Gets      atomic.Uint64
+	Sets      atomic.Uint64
+	Deletes   atomic.Uint64
+	BytesRecv atomic.Uint64
+	BytesSent atomic.Uint64
+}
+
+type countingMemcache struct {
+	memproxy.Memcache
+	counters *serverCounters
+}
+
+func (m *countingMemcache) Pipeline(ctx context.Context, options ...memproxy.PipelineOption) memproxy.Pipeline {
+	return &countingPipeline{
+		Pipeline: m.Memcache.Pipeline(ctx, options...),
+		counters: m.counters,
+	}
+}
+
+type countingPipeline struct {
+	memproxy.Pipeline
+	counters *serverCounters
+}
+
+func (p *countingPipeline) LeaseGet(key string, options memproxy.LeaseGetOptions) memproxy.LeaseGetResult {
+	p.counters.Gets.Add(1)
+	fn := p.Pipeline.LeaseGet(key, options)
+	return memproxy.LeaseGetResultFunc(func() (memproxy.LeaseGetResponse, error) {
+		resp, err := fn.Result()
+		p.counters.BytesRecv.Add(uint64(len(resp.Data)))
+		return resp, err
+	})
+}
+
+func (p *countingPipeline) LeaseSet(
+	key string, data []byte, cas uint64, options memproxy.LeaseSetOptions,
+) func() (memproxy.LeaseSetResponse, error) {
+	p.counters.Sets.Add(1)
+	p.counters.BytesSent.Add(uint64(len(data)))
+	return p.Pipeline.LeaseSet(key, data, cas, options)
+}
+
+func (p *countingPipeline) Delete(key string, options memproxy.DeleteOptions) func() (memproxy.DeleteResponse, error) {
+	p.counters.Deletes.Add(1)
+	return p.Pipeline.Delete(key, options)
+}
+
+// memcacheCluster is a memproxy client of a list of servers, with the requests counted per server
+type memcacheCluster struct {
+	client   *proxy.Memcache
+	stats    *proxy.SimpleServerStats
+	servers  []proxy.SimpleServerConfig
+	counters map[proxy.ServerID]*serverCounters
+}
+
+func newMemcacheCluster(topology string, servers []proxy.SimpleServerConfig, numConns int) (*memcacheCluster, error) {
+	c := &memcacheCluster{
+		stats:    proxy.NewSimpleStats(servers),
+		servers:  servers,
+		counters: map[proxy.ServerID]*serverCounters{},
+	}
+
+	serverIDs := mapSlice(servers, func(s proxy.SimpleServerConfig) proxy.ServerID {
+		return s.ID
+	})
+
+	var route proxy.Route
+	if topology == topologyHash {
+		route = newHashRoute(serverIDs, c.stats)
+	} else {
+		route = proxy.NewReplicatedRoute(serverIDs, c.stats)
+	}
+
+	var clientErr error
+	var opened []memproxy.Memcache
+
+	client, err := proxy.New[proxy.SimpleServerConfig](
+		proxy.Config[proxy.SimpleServerConfig]{
+			Servers: servers,
+			Route:   route,
+		},
+		func(conf proxy.SimpleServerConfig) memproxy.Memcache {
+			counters := &serverCounters{}
+			c.counters[conf.ID] = counters
+
+			mc, err := memcache.New(conf.Address(), numConns)
+			if err != nil {
+				clientErr = err
+				return nil
+			}
+			plain := memproxy.NewPlainMemcache(mc)
+			opened = append(opened, plain)
+			return &countingMemcache{
+				Memcache: plain,
+				counters: counters,
+			}
+		},
+	)
+	if err == nil {
+		err = clientErr
+	}
+	if err != nil {
+		for _, mc := range opened {
+			_ = mc.Close()
+		}
+		c.stats.Shutdown()
+		return nil, err
+	}
+
+	c.client = client
+	return c, nil
+}
+
+func (c *memcacheCluster) Close() {
+	_ = c.client.Close()
+	c.stats.Shutdown()
+}
+
+// serverResult is the requests, the bytes and the memory usage of a memcached server,
+// the requests of the warmup and cooldown phases are included
+type serverResult struct {
+	Addr      string
+	Gets      uint64
+	Sets      uint64
+	Deletes   uint64
+	BytesRecv uint64
+	BytesSent uint64
+	MemUsage  float64
+}
+
+func (c *memcacheCluster) serverResults() []serverResult {
+	return mapSlice(c.servers, func(s proxy.SimpleServerConfig) serverResult {
+		counters := c.counters[s.ID]
+		return serverResult{
+			Addr:      s.Address(),
+			Gets:      counters.Gets.Load(),
+			Sets:      counters.Sets.Load(),
+			Deletes:   counters.Deletes.Load(),
+			BytesRecv: counters.BytesRecv.Load(),
+			BytesSent: counters.BytesSent.Load(),
+			MemUsage:  c.stats.GetMemUsage(s.ID),
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/QuangTung97/memproxy"
+	"github.com/QuangTung97/memproxy/fake"
+	"github.com/QuangTung97/memproxy/proxy"
+)
+
+type fakeServerStats struct {
+	failed map[proxy.ServerID]bool
+}
+
+func (s *fakeServerStats) IsServerFailed(server proxy.ServerID) bool {
+	return s.failed[server]
+}
+
+func (s *fakeServerStats) NotifyServerFailed(server proxy.ServerID) {
+	s.failed[server] = true
+}
+
+func (s *fakeServerStats) GetMemUsage(proxy.ServerID) float64 {
+	return 0
+}
+
+func TestHashRoute_Distribution(t *testing.T) {
+	stats := &fakeServerStats{failed: map[proxy.ServerID]bool{}}
+	route := newHashRoute([]proxy.ServerID{1, 2, 3, 4}, stats)
+
+	const numKeys = 40000
+	counts := map[proxy.ServerID]int{}
+	owners := map[string]proxy.ServerID{}
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("p/SKU%07d", i)
+		server := route.NewSelector().SelectServer(key)
+		counts[server]++
+		owners[key] = server
+	}
+
+	for server, count := range counts {
+		share := float64(count) / numKeys
+		if share < 0.18 || share > 0.32 {
+			t.Errorf("unbalanced server %d: %.3f of the keys", server, share)
+		}
+	}
+
+	// removing a server only moves its own keys
+	smaller := newHashRoute([]proxy.ServerID{1, 2, 3}, stats)
+	for key, owner := range owners {
+		if owner != 4 && smaller.NewSelector().SelectServer(key) != owner {
+			t.Fatalf("key '%s' moved from server %d", key, owner)
+		}
+	}
+}
+
+func TestHashRoute_FailedServer(t *testing.T) {
+	stats := &fakeServerStats{failed: map[proxy.ServerID]bool{}}
+	route := newHashRoute([]proxy.ServerID{1, 2}, stats)
+
+	const key = "p/SKU0000001"
+	selector := route.NewSelector()
+	owner := selector.SelectServer(key)
+
+	selector.SetFailedServer(owner)
+	if !stats.failed[owner] {
+		t.Error("failed server must be notified")
+	}
+	if !selector.HasNextAvailableServer() {
+		t.Error("expected an available server")
+	}
+
+	fallback := selector.SelectServer(key)
+	if fallback == owner {
+		t.Fatalf("expected another server than %d", owner)
+	}
+	if servers := selector.SelectForDelete(key); len(servers) != 2 || servers[0] != owner || servers[1] != fallback {
+		t.Errorf("unexpected delete servers: %v", servers)
+	}
+}
+
+func TestCountingPipeline(t *testing.T) {
+	counters := &serverCounters{}
+	mc := &countingMemcache{Memcache: fake.New(), counters: counters}
+
+	pipe := mc.Pipeline(context.Background())
+	resp, err := pipe.LeaseGet("KEY01", memproxy.LeaseGetOptions{}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pipe.LeaseSet("KEY01", []byte("data"), resp.CAS, memproxy.LeaseSetOptions{})(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pipe.LeaseGet("KEY01", memproxy.LeaseGetOptions{}).Result(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pipe.Delete("KEY01", memproxy.DeleteOptions{})(); err != nil {
+		t.Fatal(err)
+	}
+	pipe.Finish()
+
+	if counters.Gets.Load() != 2 || counters.Sets.Load() != 1 || counters.Deletes.Load() != 1 {
+		t.Errorf("unexpected request counts: %d gets, %d sets, %d deletes",
+			counters.Gets.Load(), counters.Sets.Load(), counters.Deletes.Load())
+	}
+	if counters.BytesRecv.Load() != 4 || counters.BytesSent.Load() != 4 {
+		t.Errorf("unexpected byte counts: %d recv, %d sent", counters.BytesRecv.Load(), counters.BytesSent.Load())
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"bench-multiget/pb"
+)
+
+// ProductWriter is implemented by backends supporting the mixed read / write workload.
+// After UpdateProducts returns, reads from the backend should eventually return the new contents.
+type ProductWriter interface {
+	UpdateProducts(ctx context.Context, products []*pb.Product) error
+}
+
+const revisionSeparator = " rev "
+
+// newProductRevision generates the content of a product update, the revision is embedded in the name
+func newProductRevision(index int, revision uint64) *pb.Product {
+	p := newProduct(index)
+	p.Name = fmt.Sprintf("%s%s%d", p.Name, revisionSeparator, revision)
+	return p
+}
+
+// productRevision returns the revision embedded by newProductRevision, zero for the seeded products
+func productRevision(p *pb.Product) uint64 {
+	i := strings.LastIndex(p.Name, revisionSeparator)
+	if i < 0 {
+		return 0
+	}
+	rev, err := strconv.ParseUint(p.Name[i+len(revisionSeparator):], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return rev
+}
+
+// skuIndex is the inverse of the sku format used by newProduct
+func skuIndex(sku string) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(sku, "SKU"))
+	if err != nil {
+		return -1
+	}
+	return n - 1
+}
+
+const revisionLockStripes = 256
+
+// revisionTracker keeps the latest committed revision of every product,
+// reads returning an older revision than the one committed before the read started are stale
+type revisionTracker struct {
+	locks     [revisionLockStripes]sync.Mutex
+	next      []uint64
+	committed []atomic.Uint64
+}
+
+// newRevisionTracker starts the revisions after base, the backends keep the revisions written by
+// the previous runs, a base greater than them (e.g. the start time of the run) makes them compare as older
+func newRevisionTracker(numProducts int, base uint64) *revisionTracker {
+	t := &revisionTracker{
+		next:      make([]uint64, numProducts),
+		committed: make([]atomic.Uint64, numProducts),
+	}
+	for i := range t.next {
+		t.next[i] = base
+	}
+	return t
+}
+
+// write serializes the writes of the same product, so revisions are committed in order
+func (t *revisionTracker) write(index int, fn func(revision uint64) error) error {
+	lock := &t.locks[index%revisionLockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	t.next[index]++
+	rev := t.next[index]
+
+	if err := fn(rev); err != nil {
+		return err
+	}
+	t.committed[index].Store(rev)
+	return nil
+}
+
+func (t *revisionTracker) snapshot(dst []uint64, skus []string) []uint64 {
+	dst = dst[:0]
+	for _, sku := range skus {
+		var rev uint64
+		if index := skuIndex(sku); index >= 0 && index < len(t.committed) {
+			rev = t.committed[index].Load()
+		}
+		dst = append(dst, rev)
+	}
+	return dst
+}
+
+// countStale compares the returned products with the revisions of skus snapshot before the read
+func countStale(skus []string, expected []uint64, products []*pb.Product) uint64 {
+	var count uint64
+	for _, p := range products {
+		if p == nil {
+			continue
+		}
+		for i, sku := range skus {
+			if sku == p.Sku && productRevision(p) < expected[i] {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
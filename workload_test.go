@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"bench-multiget/pb"
+)
+
+func TestProductRevision(t *testing.T) {
+	if rev := productRevision(newProduct(12)); rev != 0 {
+		t.Errorf("expected revision 0 for seeded product, got %d", rev)
+	}
+
+	p := newProductRevision(12, 35)
+	if p.Sku != "SKU0000013" {
+		t.Errorf("unexpected sku: %s", p.Sku)
+	}
+	if rev := productRevision(p); rev != 35 {
+		t.Errorf("expected revision 35, got %d", rev)
+	}
+	if index := skuIndex(p.Sku); index != 12 {
+		t.Errorf("expected index 12, got %d", index)
+	}
+}
+
+func TestRevisionTracker_PreviousRun(t *testing.T) {
+	// a product written by a previous run, with more writes than the current run
+	previous := newRevisionTracker(1, 1000)
+	for i := 0; i < 57; i++ {
+		_ = previous.write(0, func(uint64) error { return nil })
+	}
+	old := newProductRevision(0, previous.snapshot(nil, []string{"SKU0000001"})[0])
+
+	tracker := newRevisionTracker(1, 2000)
+	if err := tracker.write(0, func(uint64) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	expected := tracker.snapshot(nil, []string{"SKU0000001"})
+	if expected[0] != 2001 {
+		t.Errorf("expected revision 2001, got %d", expected[0])
+	}
+	if n := countStale([]string{"SKU0000001"}, expected, []*pb.Product{old}); n != 1 {
+		t.Errorf("expected the product of the previous run to be stale, got %d", n)
+	}
+}
+
+func TestRateSustained_MixedWorkload(t *testing.T) {
+	conf := defaultBenchConfig()
+	conf.NumSkusPerBatch = 10
+	conf.Rate = 10_000
+	conf.WriteRatio = 0.2
+
+	// 800 reads of 10 keys and 200 writes in one second
+	r := benchResult{Config: conf, Duration: time.Second, TotalKeys: 8000, WriteCount: 200}
+	if !r.rateSustained() {
+		t.Errorf("expected the rate to be sustained, reads: %v per second", r.getsPerSecond())
+	}
+
+	r.WriteCount = 100
+	if r.rateSustained() {
+		t.Error("expected the rate not to be sustained")
+	}
+}
+
+// fakeStore is an in memory backend, when lagging = true writes are never visible to reads
+type fakeStore struct {
+	lagging bool
+
+	mut      sync.Mutex
+	products map[string]*pb.Product
+	writes   int
+}
+
+func newFakeStore(lagging bool) *fakeStore {
+	return &fakeStore{
+		lagging:  lagging,
+		products: map[string]*pb.Product{},
+	}
+}
+
+func (s *fakeStore) GetProducts(_ context.Context, skus []string) ([]*pb.Product, BatchStats, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	products := mapSlice(skus, func(sku string) *pb.Product {
+		p, ok := s.products[sku]
+		if !ok {
+			return newProduct(skuIndex(sku))
+		}
+		return p
+	})
+	return products, BatchStats{HitCount: uint64(len(skus))}, nil
+}
+
+func (s *fakeStore) UpdateProducts(_ context.Context, products []*pb.Product) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.writes++
+	if s.lagging {
+		return nil
+	}
+	for _, p := range products {
+		s.products[p.Sku] = p
+	}
+	return nil
+}
+
+func newWorkloadTestConfig() benchConfig {
+	conf := defaultBenchConfig()
+	conf.NumProducts = 20
+	conf.NumThreads = 4
+	conf.NumSkusPerBatch = 5
+	conf.NumLoops = 500
+	conf.WriteRatio = 0.2
+	conf.Keys.Distribution = distUniform
+	return conf
+}
+
+func TestRunMultiGet_MixedWorkload(t *testing.T) {
+	store := newFakeStore(false)
+	r := mustRunMultiGet(t, store, "fake", newWorkloadTestConfig())
+
+	if r.WriteCount == 0 || r.WriteCount != uint64(store.writes) {
+		t.Errorf("unexpected write count: %d, store writes: %d", r.WriteCount, store.writes)
+	}
+	if r.WriteCount+r.Latency.Count() != 4*500 {
+		t.Errorf("unexpected number of operations: %d", r.WriteCount+r.Latency.Count())
+	}
+	if r.WriteLatency.Count() != r.WriteCount {
+		t.Errorf("unexpected number of write latency records: %d", r.WriteLatency.Count())
+	}
+	if r.StaleReadCount != 0 {
+		t.Errorf("expected no stale reads, got %d", r.StaleReadCount)
+	}
+}
+
+func TestRunMultiGet_MixedWorkload_StaleReads(t *testing.T) {
+	store := newFakeStore(true)
+	r := mustRunMultiGet(t, store, "fake", newWorkloadTestConfig())
+
+	if r.StaleReadCount == 0 {
+		t.Error("expected stale reads")
+	}
+}